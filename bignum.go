@@ -0,0 +1,78 @@
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// WithBigNumbers makes Value and ValueInto decode numbers that int and
+// float64 cannot hold into math/big types: integers outside the range of int
+// become *big.Int and numbers outside the range of float64 become
+// *big.Float. Other numbers decode as usual.
+//
+// The digits come from the number as jq prints it. From jq 1.7 that is the
+// literal from the input for numbers the program passes through untouched,
+// so 100000000000000000001 decodes exactly; jq 1.6 keeps only the nearest
+// double and prints the shortest digits that round trip to it, so that
+// decodes as 100000000000000000000.
+func WithBigNumbers() Option {
+	return func(jq *JQ) error {
+		jq.decode.bigNumbers = true
+		return nil
+	}
+}
+
+// bigNumber converts the number jv, which is borrowed and has the value f,
+// for the bigNumbers decode option.
+func bigNumber(jv C.jv, f float64) interface{} {
+	text := dumpJson(jv)
+	if n, err := strconv.Atoi(text); err == nil {
+		return n
+	}
+	if _, err := strconv.ParseFloat(text, 64); err != nil {
+		if z, _, err := big.ParseFloat(text, 10, 0, big.ToNearestEven); err == nil {
+			return z
+		}
+	}
+	if f == math.Trunc(f) && (f < math.MinInt || f >= math.MaxInt) {
+		if n, ok := bigInt(text); ok {
+			return n
+		}
+	}
+	if C.jv_is_integer(jv) == 0 {
+		return f
+	}
+	return int(f)
+}
+
+// bigInt parses a JSON number, returning false if it is not an integer.
+func bigInt(text string) (*big.Int, bool) {
+	r, ok := new(big.Rat).SetString(text)
+	if !ok || !r.IsInt() {
+		return nil, false
+	}
+	return r.Num(), true
+}
+
+// decodeBigInt decodes the number jv, which is borrowed, into n. Unlike
+// big.Int's UnmarshalJSON it accepts integers written with an exponent, as
+// jq prints large ones.
+func (d *decodeState) decodeBigInt(jv C.jv, n *big.Int) {
+	v, ok := bigInt(dumpJson(jv))
+	if !ok {
+		d.typeError(literalName(jv), bigIntType)
+		return
+	}
+	n.Set(v)
+}
+
+// decodeBigFloat decodes the number jv, which is borrowed, into z at z's
+// precision, or 64 bits if it has none.
+func (d *decodeState) decodeBigFloat(jv C.jv, z *big.Float) {
+	if _, _, err := z.Parse(dumpJson(jv), 10); err != nil {
+		d.saveError(err)
+	}
+}
@@ -0,0 +1,122 @@
+package jq
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CachingFactory hands out compiled instances keyed by their program text,
+// for services that are sent arbitrary programs but see the same ones again
+// and again. Like Registry it keeps a pool of instances per program, so it
+// is safe for concurrent use, and it holds at most maxEntries programs,
+// closing the idle instances of the least recently used when it is full.
+type CachingFactory struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element // of *registryEntry
+	lru        *list.List               // most recently used first
+}
+
+// NewCachingFactory returns an empty factory holding up to maxEntries
+// programs, and at least one.
+func NewCachingFactory(maxEntries int) *CachingFactory {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &CachingFactory{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get returns an instance of program for the caller's sole use, compiling
+// it if no idle one is cached. Pass it to Put when done rather than closing
+// it. Programs that fail to compile are not cached.
+func (f *CachingFactory) Get(program string) (*JQ, error) {
+	f.mu.Lock()
+	if el := f.entries[program]; el != nil {
+		f.lru.MoveToFront(el)
+		entry := el.Value.(*registryEntry)
+		f.mu.Unlock()
+		return entry.get()
+	}
+	f.mu.Unlock()
+
+	// compile without holding the lock; the instance joins whichever entry
+	// exists when it is put back
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+
+	var evicted []*registryEntry
+	f.mu.Lock()
+	if el := f.entries[program]; el != nil {
+		f.lru.MoveToFront(el)
+	} else {
+		f.entries[program] = f.lru.PushFront(&registryEntry{program: program})
+		for f.lru.Len() > f.maxEntries {
+			entry := f.lru.Remove(f.lru.Back()).(*registryEntry)
+			delete(f.entries, entry.program)
+			evicted = append(evicted, entry)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, entry := range evicted {
+		entry.close()
+	}
+	return jq, nil
+}
+
+// Put returns an instance from Get for reuse. Settings changed since Get,
+// such as SetSortKeys, SetOutputOptions, SetMaxDepth and SetStderrHandler,
+// are put back to their defaults, and any outputs not yet read are
+// discarded. jq has no way to undo SetAttr, so an instance it was called on
+// is closed instead, as is one whose program has since been evicted.
+func (f *CachingFactory) Put(jq *JQ) {
+	f.mu.Lock()
+	el := f.entries[jq.program]
+	f.mu.Unlock()
+	if el == nil || jq.attrsChanged {
+		jq.Close()
+		return
+	}
+	jq.Reset()
+	jq.sortKeys = false
+	jq.output = OutputOptions{}
+	jq.maxDepth = 0
+	jq.maxOutputSize = 0
+	jq.rejectDuplicateKeys = false
+	jq.stderrHandler = nil
+	el.Value.(*registryEntry).put(jq)
+}
+
+// Run runs program over input with a cached instance and returns all of its
+// outputs. As with All, outputs produced before an error are returned along
+// with it.
+func (f *CachingFactory) Run(program string, input interface{}) ([]interface{}, error) {
+	jq, err := f.Get(program)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Put(jq)
+
+	jq.Handle(input)
+	return jq.All()
+}
+
+// Close releases every idle instance and empties the cache. Instances still
+// in use are closed when they are put back.
+func (f *CachingFactory) Close() {
+	f.mu.Lock()
+	entries := f.lru
+	f.entries = make(map[string]*list.Element)
+	f.lru = list.New()
+	f.mu.Unlock()
+
+	for el := entries.Front(); el != nil; el = el.Next() {
+		el.Value.(*registryEntry).close()
+	}
+}
@@ -0,0 +1,109 @@
+package jq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCachingFactory(t *testing.T) {
+	f := NewCachingFactory(2)
+	defer f.Close()
+
+	results, err := f.Run(".[] * 2", []int{1, 2})
+	ok(t, err)
+	equals(t, []interface{}{2, 4}, results)
+
+	_, err = f.Run(".[", nil)
+	assert(t, err != nil, "expected a compile error")
+	equals(t, 1, len(f.entries))
+
+	// idle instances are reused
+	a, err := f.Get(".name")
+	ok(t, err)
+	f.Put(a)
+	b, err := f.Get(".name")
+	ok(t, err)
+	equals(t, a, b)
+
+	// a third program evicts the least recently used, closing its instances
+	// now if idle and when put back if not
+	double := f.entries[".[] * 2"].Value.(*registryEntry)
+	_, err = f.Run(".id", map[string]int{"id": 7})
+	ok(t, err)
+	equals(t, 2, len(f.entries))
+	equals(t, true, double.closed)
+	equals(t, 0, len(double.idle))
+	_, cached := f.entries[".name"]
+	equals(t, true, cached)
+
+	_, err = f.Run(".[] * 2", []int{3})
+	ok(t, err)
+	f.Put(b)
+	_, cached = f.entries[".name"]
+	equals(t, false, cached)
+}
+
+func TestCachingFactoryResetsSettings(t *testing.T) {
+	f := NewCachingFactory(1)
+	defer f.Close()
+
+	a, err := f.Get(".")
+	ok(t, err)
+	a.SetSortKeys(true)
+	ok(t, a.SetOutputOptions(OutputOptions{Pretty: true}))
+	a.Handle(map[string]int{"b": 1, "a": 2})
+	equals(t, true, a.Next())
+	equals(t, "{\n  \"a\": 2,\n  \"b\": 1\n}", a.ValueJson())
+	a.SetMaxDepth(1)
+	a.Handle(1)
+	f.Put(a)
+
+	b, err := f.Get(".")
+	ok(t, err)
+	equals(t, a, b)
+	equals(t, false, b.Next())
+	b.Handle(&orderedMap{[]string{"b", "a"}, map[string]interface{}{"b": []int{1}, "a": 2}})
+	equals(t, true, b.Next())
+	equals(t, `{"b":[1],"a":2}`, b.ValueJson())
+
+	// attributes cannot be reset, so the instance is not reused
+	ok(t, b.SetAttr("CUSTOM", 1))
+	f.Put(b)
+	c, err := f.Get(".")
+	ok(t, err)
+	assert(t, c != b, "expected a fresh instance")
+	equals(t, nil, c.GetAttr("CUSTOM"))
+	f.Put(c)
+}
+
+func TestCachingFactoryConcurrent(t *testing.T) {
+	f := NewCachingFactory(3)
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				n := (i + j) % 4
+				results, err := f.Run(fmt.Sprintf(". + %d", n), j)
+				if err == nil && (len(results) != 1 || results[0] != j+n) {
+					err = fmt.Errorf("unexpected results for %d+%d: %v", j, n, results)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		ok(t, err)
+	}
+	assert(t, len(f.entries) <= 3, "expected at most 3 cached programs, got %d", len(f.entries))
+}
@@ -0,0 +1,46 @@
+package jq
+
+// #include <jq.h>
+import "C"
+import (
+	"io"
+	"runtime/cgo"
+	"unsafe"
+)
+
+// Callbacks registered with jq receive the instance's cgo.Handle as their
+// data pointer, since C may not keep hold of Go pointers.
+
+func handleJQ(data unsafe.Pointer) *JQ {
+	return cgo.Handle(uintptr(data)).Value().(*JQ)
+}
+
+//export goJqErrorCallback
+func goJqErrorCallback(data unsafe.Pointer, msg C.jv) {
+	jq := handleJQ(data)
+	if C.jv_get_kind(msg) == C.JV_KIND_STRING {
+		jq.errorMessages = append(jq.errorMessages, jvGoString(msg))
+	} else {
+		jq.errorMessages = append(jq.errorMessages, dumpJson(msg))
+	}
+	freeJv(msg)
+}
+
+// goJqInputCallback feeds the input and inputs builtins. An invalid value
+// without a message tells jq there are no more inputs.
+//
+//export goJqInputCallback
+func goJqInputCallback(state *C.jq_state, data unsafe.Pointer) C.jv {
+	jq := handleJQ(data)
+	if jq.inputs == nil {
+		return C.jv_invalid()
+	}
+	v, err := jq.inputs.next()
+	if err == io.EOF {
+		return C.jv_invalid()
+	} else if err != nil {
+		return C.jv_invalid_with_msg(jvString(err.Error()))
+	}
+	jq.inputsRead++
+	return v
+}
@@ -0,0 +1,80 @@
+package jq
+
+import (
+	"math"
+	"strconv"
+)
+
+// CanonicalizeNumbers rewrites every number in the JSON text src in a
+// canonical form, so output can be compared across builds of libjq that
+// print numbers differently. jq 1.6 prints the shortest digits that round
+// trip, switching to an exponent outside 1e-5 to 1e17 (so 1e-07 and
+// 1e+17), while other versions differ in where they switch and whether
+// they keep the literal as written.
+//
+// The canonical form is the one used by encoding/json and JavaScript: the
+// shortest round-tripping digits of the float64 value, with an exponent only
+// below 1e-6 or from 1e21, written without leading zeros (1e-7, 1e+21).
+// Strings and ANSI color escapes are copied unchanged.
+func CanonicalizeNumbers(src []byte) []byte {
+	return appendCanonicalNumbers(make([]byte, 0, len(src)), src)
+}
+
+func appendCanonicalNumbers(dst, src []byte) []byte {
+	for i := 0; i < len(src); {
+		c := src[i]
+		j := i + 1
+		switch {
+		case c == '"':
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(src))
+			dst = append(dst, src[i:j]...)
+		case c == 0x1b:
+			for j < len(src) && src[j] != 'm' {
+				j++
+			}
+			j = min(j+1, len(src))
+			dst = append(dst, src[i:j]...)
+		case c == '-' || '0' <= c && c <= '9':
+			for j < len(src) && isNumberByte(src[j]) {
+				j++
+			}
+			dst = appendCanonicalNumber(dst, src[i:j])
+		default:
+			dst = append(dst, c)
+		}
+		i = j
+	}
+	return dst
+}
+
+func isNumberByte(c byte) bool {
+	return '0' <= c && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-'
+}
+
+func appendCanonicalNumber(dst, token []byte) []byte {
+	f, err := strconv.ParseFloat(string(token), 64)
+	if err != nil {
+		return append(dst, token...)
+	}
+	// matches encoding/json's float64 encoder
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
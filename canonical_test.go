@@ -0,0 +1,41 @@
+package jq
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanonicalizeNumbers(t *testing.T) {
+	for _, tc := range []struct{ in, out string }{
+		{`3`, `3`},
+		{`1e-07`, `1e-7`},
+		{`1e+17`, `100000000000000000`},
+		{`1.5e+300`, `1.5e+300`},
+		{`-0`, `-0`},
+		{`1e-06`, `0.000001`},
+		{`123456789012345680`, `123456789012345680`},
+		{`[1e+20,{"a1e+20":2.50}]`, `[100000000000000000000,{"a1e+20":2.5}]`},
+		{`"\"1e+20"`, `"\"1e+20"`},
+		{"[\n  1e+17\n]", "[\n  100000000000000000\n]"},
+	} {
+		equals(t, tc.out, string(CanonicalizeNumbers([]byte(tc.in))))
+	}
+}
+
+func TestCanonicalNumbersOption(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.SetOutputOptions(OutputOptions{CanonicalNumbers: true, Color: true}))
+	ok(t, jq.HandleJson(`{"n": 1e17, "s": "1e17"}`))
+	equals(t, true, jq.Next())
+	color := jq.ValueJson()
+
+	ok(t, jq.SetOutputOptions(OutputOptions{CanonicalNumbers: true}))
+	ok(t, jq.Rerun())
+	equals(t, true, jq.Next())
+	equals(t, `{"n":100000000000000000,"s":"1e17"}`, jq.ValueJson())
+	equals(t, `{"n":100000000000000000,"s":"1e17"}`, string(jq.AppendValueJson(nil)))
+	assert(t, strings.Contains(color, "\x1b[") && strings.Contains(color, "100000000000000000"), "unexpected colored output: %q", color)
+}
@@ -0,0 +1,201 @@
+package jq
+
+import "strings"
+
+// CardinalityHint guesses from the program text how many outputs the
+// program produces for each input: "single" for at most one, "multi" if it
+// may produce more, or "unknown" if the text could not be analysed, e.g.
+// because it imports modules or fails to lex.
+//
+// It is a heuristic for planning, not a guarantee. It looks for the usual
+// sources of several outputs: iteration such as .[] and .., the comma
+// operator, foreach, and builtins that generate streams such as range,
+// recurse, paths, inputs, and match and capture with the "g" flag. These
+// are not counted inside an array constructor, the source of a reduce, the
+// paths on the left of an update such as .[] |= f, or the arguments of
+// builtins that gather their argument's outputs such as first, any and
+// map. A function defined in the program counts where it is called, if its
+// body has one of them. Anything else, such as select(.[] > 1), limit(1; f)
+// with f generating, or match without "g", errs towards "multi".
+func (jq *JQ) CardinalityHint() string {
+	return cardinalityHint(jq.program)
+}
+
+// streamBuiltins are the builtins that may produce several outputs whatever
+// their arguments.
+var streamBuiltins = map[string]bool{
+	"range": true, "recurse": true, "recurse_down": true, "inputs": true,
+	"paths": true, "leaf_paths": true, "splits": true, "scan": true,
+	"combinations": true, "repeat": true, "while": true, "limit": true,
+	"tostream": true, "truncate_stream": true, "fromstream": true,
+	// one output per match with the "g" flag
+	"match": true, "capture": true,
+}
+
+// gatheringBuiltins produce at most one output however many their
+// arguments do.
+var gatheringBuiltins = map[string]bool{
+	"first": true, "last": true, "nth": true, "isempty": true, "any": true,
+	"all": true, "map": true, "with_entries": true, "del": true,
+	"sort_by": true, "group_by": true, "unique_by": true, "min_by": true,
+	"max_by": true,
+}
+
+var updateOperators = map[string]bool{
+	"=": true, "|=": true, "+=": true, "-=": true, "*=": true, "/=": true,
+	"%=": true, "//=": true,
+}
+
+// cardinalityScope is one level of nesting while scanning for multiple
+// outputs.
+type cardinalityScope struct {
+	close string // the token that ends it
+
+	// gathers reports whether outputs inside the scope are collected into
+	// one, as in [...]
+	gathers bool
+	object  bool
+
+	// multi is set by a source of outputs in the current pipe segment,
+	// which an update operator can still discount, and fanout by one that
+	// can no longer be discounted
+	multi, fanout bool
+
+	// for a function definition, its name once the body starts
+	def string
+}
+
+func cardinalityHint(program string) string {
+	tokens, ok := lexJq(program)
+	if !ok {
+		return "unknown"
+	}
+
+	multiFuncs := map[string]bool{}
+	scopes := []*cardinalityScope{{}}
+	pop := func() bool {
+		s := scopes[len(scopes)-1]
+		scopes = scopes[:len(scopes)-1]
+		if len(scopes) == 0 {
+			return false
+		}
+		multi := s.multi || s.fanout
+		if s.def != "" {
+			multiFuncs[s.def] = multi
+		} else if multi && !s.gathers {
+			scopes[len(scopes)-1].multi = true
+		}
+		return true
+	}
+
+	for i, tok := range tokens {
+		cur := scopes[len(scopes)-1]
+		var prev, next jqToken
+		if i > 0 {
+			prev = tokens[i-1]
+		}
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+
+		switch tok.kind {
+		case tokIdent:
+			switch {
+			case strings.Contains(tok.text, "::"):
+				return "unknown"
+			case cur.object && next.kind == tokPunct && next.text == ":":
+				// an object key
+			case prev.kind == tokKeyword && prev.text == "def":
+				cur.def = tok.text
+			case streamBuiltins[tok.text] || multiFuncs[tok.text]:
+				cur.multi = true
+			}
+
+		case tokKeyword:
+			switch tok.text {
+			case "import", "include":
+				return "unknown"
+			case "foreach":
+				cur.multi = true
+			case "reduce":
+				// the source, up to as, is gathered
+				scopes = append(scopes, &cardinalityScope{close: "as", gathers: true})
+			case "as":
+				if cur.close == "as" {
+					pop()
+				}
+			case "def":
+				scopes = append(scopes, &cardinalityScope{close: ";"})
+			case "if":
+				scopes = append(scopes, &cardinalityScope{close: "end"})
+			case "end":
+				if cur.close != "end" || !pop() {
+					return "unknown"
+				}
+			}
+
+		case tokRecurse:
+			cur.multi = true
+
+		case tokPunct:
+			switch tok.text {
+			case "(", `\(`:
+				s := &cardinalityScope{close: ")"}
+				if tok.text == "(" && prev.kind == tokIdent {
+					s.gathers = gatheringBuiltins[prev.text]
+				}
+				scopes = append(scopes, s)
+			case "[":
+				if next.kind == tokPunct && next.text == "]" && (prev.kind == tokDot || endsTerm(prev)) {
+					// .[] iterates
+					cur.multi = true
+				}
+				// an array constructor gathers, an index does not
+				iterates := prev.kind == tokDot || endsTerm(prev)
+				scopes = append(scopes, &cardinalityScope{close: "]", gathers: !iterates})
+			case "{":
+				scopes = append(scopes, &cardinalityScope{close: "}", object: true})
+			case ")", "]", "}":
+				if cur.close != tok.text || !pop() {
+					return "unknown"
+				}
+			case "|":
+				cur.fanout = cur.fanout || cur.multi
+				cur.multi = false
+			case ",":
+				if cur.object {
+					cur.fanout = cur.fanout || cur.multi
+					cur.multi = false
+				} else {
+					cur.fanout = true
+				}
+			case ":":
+				if cur.def != "" && cur.close == ";" {
+					// the body starts; what the header held does not count
+					cur.multi, cur.fanout = false, false
+				}
+			case ";":
+				switch cur.close {
+				case ";":
+					pop()
+				default:
+					cur.fanout = cur.fanout || cur.multi
+					cur.multi = false
+				}
+			default:
+				if updateOperators[tok.text] {
+					// the left hand side gives paths, not outputs
+					cur.multi = false
+				}
+			}
+		}
+	}
+
+	if len(scopes) != 1 {
+		return "unknown"
+	}
+	if scopes[0].multi || scopes[0].fanout {
+		return "multi"
+	}
+	return "single"
+}
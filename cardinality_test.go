@@ -0,0 +1,51 @@
+package jq
+
+import "testing"
+
+func TestCardinalityHint(t *testing.T) {
+	for _, tc := range []struct {
+		program string
+		hint    string
+	}{
+		{`.`, "single"},
+		{`.a.b`, "single"},
+		{`.[0]`, "single"},
+		{`[.[]]`, "single"},
+		{`[.[] | .x] | length`, "single"},
+		{`first(range(5))`, "single"},
+		{`map(.a, .b)`, "single"},
+		{`.[] |= . + 1`, "single"},
+		{`(.a, .b) |= 1`, "single"},
+		{`reduce .[] as $x (0; . + $x)`, "single"},
+		{`{a: 1, b: .c}`, "single"},
+		{`if . then 1 else 2 end`, "single"},
+		{`def f: .a; f`, "single"},
+
+		{`.[]`, "multi"},
+		{`.a[]`, "multi"},
+		{`..`, "multi"},
+		{`range(5)`, "multi"},
+		{`.a, .b`, "multi"},
+		{`{a: .[]}`, "multi"},
+		{`"\(1, 2)"`, "multi"},
+		{`.[] | .x`, "multi"},
+		{`[.[]] | .[]`, "multi"},
+		{`if . then .[] else 1 end`, "multi"},
+		{`def f: .[]; f`, "multi"},
+		{`foreach .[] as $x (0; . + $x)`, "multi"},
+		{`select(.[] > 1)`, "multi"},
+		{`match("a"; "g")`, "multi"},
+		{`capture("(?<x>a)"; "g") | .x`, "multi"},
+		{`[match("a"; "g")] | length`, "single"},
+
+		{`.[`, "unknown"},
+		{`(.a]`, "unknown"},
+		{`"abc`, "unknown"},
+		{`import "m" as m; m::f`, "unknown"},
+	} {
+		// built directly so programs jq would reject can be scanned too
+		jq := &JQ{program: tc.program}
+		hint := jq.CardinalityHint()
+		assert(t, hint == tc.hint, "CardinalityHint(%q) = %q, want %q", tc.program, hint, tc.hint)
+	}
+}
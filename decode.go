@@ -0,0 +1,724 @@
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ValueInto decodes the current output into dest, which must be a non-nil
+// pointer. It follows the rules of encoding/json's Unmarshal, including
+// struct tags and the Unmarshaler interfaces, but walks jq's value directly
+// instead of going through JSON text. When the target is an interface{} the
+// result is the same as Value's, so integral numbers decode as int.
+func (jq *JQ) ValueInto(dest interface{}) error {
+	return decodeInto(jq.lastValue, dest, jq.decode)
+}
+
+// ForEach decodes each remaining output for the current input into a T, as
+// ValueInto does, and passes it to fn. It stops at the first decoding error
+// or error from fn, discarding the remaining outputs, and otherwise returns
+// Err once the outputs run out.
+func ForEach[T any](jq *JQ, fn func(T) error) error {
+	for jq.Next() {
+		var v T
+		if err := jq.ValueInto(&v); err != nil {
+			jq.drain()
+			return err
+		}
+		if err := fn(v); err != nil {
+			jq.drain()
+			return err
+		}
+	}
+	return jq.Err()
+}
+
+// DecodeAll decodes each remaining output for the current input into a T,
+// as ValueInto does, and returns those that decoded along with the errors
+// met on the way. With skipErrors an output that fails to decode is
+// skipped and its error collected; without it the first such error stops
+// the run. A runtime error from the program always ends the outputs, as
+// Err explains, and is collected last.
+func DecodeAll[T any](jq *JQ, skipErrors bool) ([]T, []error) {
+	var results []T
+	var errs []error
+	for jq.Next() {
+		var v T
+		if err := jq.ValueInto(&v); err != nil {
+			errs = append(errs, err)
+			if !skipErrors {
+				jq.drain()
+				return results, errs
+			}
+			continue
+		}
+		results = append(results, v)
+	}
+	if err := jq.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return results, errs
+}
+
+// Decode decodes v into dest in the same way as JQ.ValueInto.
+func (v Value) Decode(dest interface{}) error {
+	return decodeInto(v.jv, dest, decodeOptions{})
+}
+
+// Presence records which object keys appeared in a decoded value, by their jq
+// path such as ".name" or ".items[0].id". A key that was present with a null
+// value is recorded, an absent one is not, which is the distinction decoding
+// into zero values loses.
+type Presence map[string]bool
+
+// Has reports whether the key at path was present.
+func (p Presence) Has(path string) bool {
+	return p[path]
+}
+
+// ValueIntoWithPresence is like ValueInto but also reports which keys were
+// present in the output, for implementing partial updates.
+func (jq *JQ) ValueIntoWithPresence(dest interface{}) (Presence, error) {
+	return decodeWithPresence(jq.lastValue, dest, jq.decode)
+}
+
+// DecodeWithPresence is like Decode but also reports which keys were
+// present in v.
+func (v Value) DecodeWithPresence(dest interface{}) (Presence, error) {
+	return decodeWithPresence(v.jv, dest, decodeOptions{})
+}
+
+func decodeWithPresence(jv C.jv, dest interface{}, opts decodeOptions) (Presence, error) {
+	if err := decodeInto(jv, dest, opts); err != nil {
+		return nil, err
+	}
+	presence := Presence{}
+	presence.collect(jv, "")
+	return presence, nil
+}
+
+func (p Presence) collect(jv C.jv, path string) {
+	switch C.jv_get_kind(jv) {
+	case C.JV_KIND_ARRAY:
+		n := int(C.jv_array_length(C.jv_copy(jv)))
+		for i := 0; i < n; i++ {
+			item := trackJv(C.jv_array_get(C.jv_copy(jv), C.int(i)))
+			p.collect(item, joinPath(path, "["+strconv.Itoa(i)+"]"))
+			freeJv(item)
+		}
+	case C.JV_KIND_OBJECT:
+		for i := C.jv_object_iter(jv); C.jv_object_iter_valid(jv, i) != 0; i = C.jv_object_iter_next(jv, i) {
+			k := trackJv(C.jv_object_iter_key(jv, i))
+			keyPath := joinPath(path, pathKey(jvGoString(k)))
+			freeJv(k)
+			p[keyPath] = true
+
+			item := trackJv(C.jv_object_iter_value(jv, i))
+			p.collect(item, keyPath)
+			freeJv(item)
+		}
+	}
+}
+
+func decodeInto(jv C.jv, dest interface{}, opts decodeOptions) error {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &json.InvalidUnmarshalError{Type: reflect.TypeOf(dest)}
+	}
+	d := &decodeState{opts: opts}
+	d.value(jv, rv)
+	return d.err
+}
+
+// decodeState walks a jv into a reflect.Value. Like encoding/json it keeps
+// going after a type mismatch and reports the first one it saw.
+type decodeState struct {
+	err        error
+	structType reflect.Type
+	fields     []string
+	opts       decodeOptions
+}
+
+var (
+	numberType = reflect.TypeOf(json.Number(""))
+	bigIntType = reflect.TypeOf(big.Int{})
+)
+
+// string returns the string jv, which is borrowed, after normalization.
+func (d *decodeState) string(jv C.jv) string {
+	return d.opts.string(jvGoString(jv))
+}
+
+// toGo converts jv, which is borrowed, as Value does.
+func (d *decodeState) toGo(jv C.jv) interface{} {
+	return jvToGoKind(jv, C.jv_get_kind(jv), d.opts)
+}
+
+func (d *decodeState) saveError(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decodeState) typeError(what string, t reflect.Type) {
+	err := &json.UnmarshalTypeError{Value: what, Type: t}
+	if d.structType != nil {
+		err.Struct = d.structType.Name()
+		err.Field = strings.Join(d.fields, ".")
+	}
+	d.saveError(err)
+}
+
+// value decodes jv, which is borrowed, into v.
+func (d *decodeState) value(jv C.jv, v reflect.Value) {
+	switch C.jv_get_kind(jv) {
+	case C.JV_KIND_NULL:
+		d.null(jv, v)
+	case C.JV_KIND_NUMBER:
+		// NaN decodes as the null jq prints for it
+		if _, ok := jsonFloat(jv); !ok {
+			d.null(jv, v)
+		} else {
+			d.literal(jv, v)
+		}
+	case C.JV_KIND_TRUE, C.JV_KIND_FALSE, C.JV_KIND_STRING:
+		d.literal(jv, v)
+	case C.JV_KIND_ARRAY:
+		d.array(jv, v)
+	case C.JV_KIND_OBJECT:
+		d.object(jv, v)
+	default:
+		d.saveError(errors.New("jq: cannot decode invalid value"))
+	}
+}
+
+func (d *decodeState) null(jv C.jv, v reflect.Value) {
+	u, _, pv := indirect(v, true)
+	if u != nil {
+		d.saveError(u.UnmarshalJSON([]byte("null")))
+		return
+	}
+	switch pv.Kind() {
+	case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+		pv.Set(reflect.Zero(pv.Type()))
+	}
+}
+
+func (d *decodeState) literal(jv C.jv, v reflect.Value) {
+	kind := C.jv_get_kind(jv)
+	u, ut, pv := indirect(v, false)
+	if n, ok := u.(*big.Int); ok && kind == C.JV_KIND_NUMBER {
+		d.decodeBigInt(jv, n)
+		return
+	}
+	if z, ok := ut.(*big.Float); ok && kind == C.JV_KIND_NUMBER {
+		d.decodeBigFloat(jv, z)
+		return
+	}
+	if u != nil {
+		d.saveError(u.UnmarshalJSON([]byte(dumpJson(jv))))
+		return
+	}
+	if ut != nil {
+		if kind != C.JV_KIND_STRING {
+			d.typeError(literalName(jv), v.Type())
+			return
+		}
+		text := jvStringBytes(jv)
+		if d.opts.normalize != nil {
+			text = []byte(d.opts.normalize(string(text)))
+		}
+		d.saveError(ut.UnmarshalText(text))
+		return
+	}
+
+	switch kind {
+	case C.JV_KIND_TRUE, C.JV_KIND_FALSE:
+		b := kind == C.JV_KIND_TRUE
+		switch {
+		case pv.Kind() == reflect.Bool:
+			pv.SetBool(b)
+		case pv.Kind() == reflect.Interface && pv.NumMethod() == 0:
+			pv.Set(reflect.ValueOf(b))
+		default:
+			d.typeError("bool", pv.Type())
+		}
+
+	case C.JV_KIND_STRING:
+		switch {
+		case pv.Kind() == reflect.String:
+			pv.SetString(d.string(jv))
+		case pv.Kind() == reflect.Slice && pv.Type().Elem().Kind() == reflect.Uint8:
+			b, err := base64.StdEncoding.DecodeString(jvGoString(jv))
+			if err != nil {
+				d.saveError(err)
+				return
+			}
+			pv.SetBytes(b)
+		case pv.Kind() == reflect.Interface && pv.NumMethod() == 0:
+			pv.Set(reflect.ValueOf(d.string(jv)))
+		default:
+			d.typeError("string", pv.Type())
+		}
+
+	case C.JV_KIND_NUMBER:
+		d.number(jv, pv)
+	}
+}
+
+func (d *decodeState) number(jv C.jv, v reflect.Value) {
+	f, _ := jsonFloat(jv)
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			d.typeError("number", v.Type())
+			return
+		}
+		v.Set(reflect.ValueOf(d.toGo(jv)))
+	case reflect.String:
+		if v.Type() != numberType {
+			d.typeError("number", v.Type())
+			return
+		}
+		v.SetString(dumpJson(jv))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || v.OverflowInt(int64(f)) {
+			d.typeError(literalName(jv), v.Type())
+			return
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || v.OverflowUint(uint64(f)) {
+			d.typeError(literalName(jv), v.Type())
+			return
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		if v.OverflowFloat(f) {
+			d.typeError(literalName(jv), v.Type())
+			return
+		}
+		v.SetFloat(f)
+	default:
+		d.typeError("number", v.Type())
+	}
+}
+
+func (d *decodeState) array(jv C.jv, v reflect.Value) {
+	u, ut, pv := indirect(v, false)
+	if u != nil {
+		d.saveError(u.UnmarshalJSON([]byte(dumpJson(jv))))
+		return
+	}
+	if ut != nil {
+		d.typeError("array", v.Type())
+		return
+	}
+
+	n := int(C.jv_array_length(C.jv_copy(jv)))
+	switch pv.Kind() {
+	case reflect.Interface:
+		if pv.NumMethod() != 0 {
+			d.typeError("array", pv.Type())
+			return
+		}
+		pv.Set(reflect.ValueOf(d.toGo(jv)))
+		return
+	case reflect.Slice:
+		if pv.Cap() >= n {
+			pv.SetLen(n)
+		} else {
+			pv.Set(reflect.MakeSlice(pv.Type(), n, n))
+		}
+	case reflect.Array:
+	default:
+		d.typeError("array", pv.Type())
+		return
+	}
+
+	for i := 0; i < pv.Len(); i++ {
+		if i >= n {
+			pv.Index(i).Set(reflect.Zero(pv.Type().Elem()))
+			continue
+		}
+		item := trackJv(C.jv_array_get(C.jv_copy(jv), C.int(i)))
+		d.value(item, pv.Index(i))
+		freeJv(item)
+	}
+}
+
+func (d *decodeState) object(jv C.jv, v reflect.Value) {
+	u, ut, pv := indirect(v, false)
+	if u != nil {
+		d.saveError(u.UnmarshalJSON([]byte(dumpJson(jv))))
+		return
+	}
+	if ut != nil {
+		d.typeError("object", v.Type())
+		return
+	}
+
+	switch pv.Kind() {
+	case reflect.Interface:
+		if pv.NumMethod() != 0 {
+			d.typeError("object", pv.Type())
+			return
+		}
+		pv.Set(reflect.ValueOf(d.toGo(jv)))
+	case reflect.Map:
+		d.mapObject(jv, pv)
+	case reflect.Struct:
+		d.structObject(jv, pv)
+	default:
+		d.typeError("object", pv.Type())
+	}
+}
+
+func (d *decodeState) mapObject(jv C.jv, v reflect.Value) {
+	t := v.Type()
+	keyType := t.Key()
+	switch keyType.Kind() {
+	case reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		if !reflect.PointerTo(keyType).Implements(textUnmarshalerType) {
+			d.typeError("object", t)
+			return
+		}
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(t))
+	}
+
+	for i := C.jv_object_iter(jv); C.jv_object_iter_valid(jv, i) != 0; i = C.jv_object_iter_next(jv, i) {
+		k := trackJv(C.jv_object_iter_key(jv, i))
+		key := d.string(k)
+		freeJv(k)
+
+		item := trackJv(C.jv_object_iter_value(jv, i))
+		elem := reflect.New(t.Elem()).Elem()
+		d.value(item, elem)
+		freeJv(item)
+
+		kv, err := mapKey(key, keyType)
+		if err != nil {
+			d.saveError(err)
+			continue
+		}
+		v.SetMapIndex(kv, elem)
+	}
+}
+
+func mapKey(key string, t reflect.Type) (reflect.Value, error) {
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		kv := reflect.New(t)
+		if err := kv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(key)); err != nil {
+			return reflect.Value{}, err
+		}
+		return kv.Elem(), nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(key).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowInt(n) {
+			return reflect.Value{}, &json.UnmarshalTypeError{Value: "number " + key, Type: t}
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	default:
+		n, err := strconv.ParseUint(key, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowUint(n) {
+			return reflect.Value{}, &json.UnmarshalTypeError{Value: "number " + key, Type: t}
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	}
+}
+
+func (d *decodeState) structObject(jv C.jv, v reflect.Value) {
+	fields := cachedTypeFields(v.Type())
+	for i := C.jv_object_iter(jv); C.jv_object_iter_valid(jv, i) != 0; i = C.jv_object_iter_next(jv, i) {
+		k := trackJv(C.jv_object_iter_key(jv, i))
+		f := fields.lookup(d.string(k))
+		freeJv(k)
+		if f == nil {
+			continue
+		}
+
+		subv, ok := fieldByIndex(v, f.index)
+		if !ok {
+			d.saveError(errors.New("jq: cannot set embedded pointer to unexported struct: " + v.Type().String()))
+			continue
+		}
+
+		outerStruct, outerFields := d.structType, d.fields
+		d.structType, d.fields = v.Type(), append(d.fields, f.name)
+
+		item := trackJv(C.jv_object_iter_value(jv, i))
+		if f.quoted {
+			d.quoted(item, subv)
+		} else {
+			d.value(item, subv)
+		}
+		freeJv(item)
+
+		d.structType, d.fields = outerStruct, outerFields
+	}
+}
+
+// quoted handles fields tagged with the ",string" option, whose scalar
+// value is encoded inside a JSON string.
+func (d *decodeState) quoted(jv C.jv, v reflect.Value) {
+	switch C.jv_get_kind(jv) {
+	case C.JV_KIND_NULL:
+		d.null(jv, v)
+		return
+	case C.JV_KIND_STRING:
+	default:
+		d.typeError(literalName(jv), v.Type())
+		return
+	}
+
+	inner, err := parseJson(jvGoString(jv))
+	if err != nil {
+		d.saveError(errors.New("jq: invalid use of ,string struct tag, trying to decode " + dumpJson(jv) + " into " + v.Type().String()))
+		return
+	}
+	switch C.jv_get_kind(inner) {
+	case C.JV_KIND_ARRAY, C.JV_KIND_OBJECT:
+		d.saveError(errors.New("jq: invalid use of ,string struct tag, trying to decode " + dumpJson(jv) + " into " + v.Type().String()))
+	default:
+		d.value(inner, v)
+	}
+	freeJv(inner)
+}
+
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func literalName(jv C.jv) string {
+	switch C.jv_get_kind(jv) {
+	case C.JV_KIND_TRUE, C.JV_KIND_FALSE:
+		return "bool"
+	case C.JV_KIND_NUMBER:
+		return "number " + dumpJson(jv)
+	case C.JV_KIND_STRING:
+		return "string"
+	case C.JV_KIND_NULL:
+		return "null"
+	}
+	return kindName(C.jv_get_kind(jv))
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// indirect walks down v, allocating pointers as needed, until it reaches a
+// non-pointer or a type implementing one of the Unmarshaler interfaces. If
+// decodingNull is true it stops at the last settable pointer so it can be
+// set to nil. This mirrors the function of the same name in encoding/json.
+func indirect(v reflect.Value, decodingNull bool) (json.Unmarshaler, encoding.TextUnmarshaler, reflect.Value) {
+	if v.Kind() != reflect.Ptr && v.Type().Name() != "" && v.CanAddr() {
+		v = v.Addr()
+	}
+	for {
+		if v.Kind() == reflect.Interface && !v.IsNil() {
+			e := v.Elem()
+			if e.Kind() == reflect.Ptr && !e.IsNil() && (!decodingNull || e.Elem().Kind() == reflect.Ptr) {
+				v = e
+				continue
+			}
+		}
+
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if decodingNull && v.CanSet() {
+			break
+		}
+		if v.Elem().Kind() == reflect.Interface && v.Elem().Elem() == v {
+			v = v.Elem()
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if v.Type().NumMethod() > 0 && v.CanInterface() {
+			if u, ok := v.Interface().(json.Unmarshaler); ok {
+				return u, nil, reflect.Value{}
+			}
+			if !decodingNull {
+				if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
+					return nil, u, reflect.Value{}
+				}
+			}
+		}
+		v = v.Elem()
+	}
+	return nil, nil, v
+}
+
+// Struct fields
+
+type field struct {
+	name   string
+	tagged bool
+	index  []int
+	quoted bool
+}
+
+type structFields struct {
+	list   []field
+	byName map[string]*field
+}
+
+func (fs *structFields) lookup(name string) *field {
+	if f, ok := fs.byName[name]; ok {
+		return f
+	}
+	for i := range fs.list {
+		if strings.EqualFold(fs.list[i].name, name) {
+			return &fs.list[i]
+		}
+	}
+	return nil
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+func cachedTypeFields(t reflect.Type) *structFields {
+	if fs, ok := fieldCache.Load(t); ok {
+		return fs.(*structFields)
+	}
+	fs, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fs.(*structFields)
+}
+
+// typeFields returns the fields encoding/json would decode into for t,
+// applying its rules for tags and for fields promoted from embedded structs:
+// shallower fields win, and among fields at the same depth a single tagged
+// one wins, otherwise the name is ambiguous and ignored.
+func typeFields(t reflect.Type) *structFields {
+	type candidate struct {
+		typ   reflect.Type
+		index []int
+	}
+	current := []candidate{}
+	next := []candidate{{typ: t}}
+	visited := map[reflect.Type]bool{}
+	seen := map[string]bool{}
+	var fields []field
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		byName := map[string][]field{}
+		var order []string
+
+		for _, c := range current {
+			if visited[c.typ] {
+				continue
+			}
+			visited[c.typ] = true
+
+			for i := 0; i < c.typ.NumField(); i++ {
+				sf := c.typ.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					if !sf.IsExported() && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if !sf.IsExported() {
+					continue
+				}
+
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int{}, c.index...), i)
+
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, candidate{ft, index})
+					continue
+				}
+
+				tagged := name != ""
+				if name == "" {
+					name = sf.Name
+				}
+				quoted := false
+				for _, opt := range strings.Split(opts, ",") {
+					if opt == "string" {
+						switch ft.Kind() {
+						case reflect.Bool, reflect.String,
+							reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+							reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+							reflect.Float32, reflect.Float64:
+							quoted = true
+						}
+					}
+				}
+
+				if _, ok := byName[name]; !ok {
+					order = append(order, name)
+				}
+				byName[name] = append(byName[name], field{name, tagged, index, quoted})
+			}
+		}
+
+		for _, name := range order {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			candidates := byName[name]
+			if len(candidates) == 1 {
+				fields = append(fields, candidates[0])
+				continue
+			}
+			var dominant []field
+			for _, f := range candidates {
+				if f.tagged {
+					dominant = append(dominant, f)
+				}
+			}
+			if len(dominant) == 1 {
+				fields = append(fields, dominant[0])
+			}
+		}
+	}
+
+	fs := &structFields{list: fields, byName: make(map[string]*field, len(fields))}
+	for i := range fs.list {
+		fs.byName[fs.list[i].name] = &fs.list[i]
+	}
+	return fs
+}
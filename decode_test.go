@@ -0,0 +1,321 @@
+package jq
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertDecoded(t *testing.T, json string, dest interface{}) {
+	jv, err := parseJson(json)
+	ok(t, err)
+	defer freeJv(jv)
+	ok(t, decodeInto(jv, dest, decodeOptions{}))
+}
+
+type record struct {
+	Name    string         `json:"name"`
+	Age     int            `json:"age,omitempty"`
+	Tags    []string       `json:"tags"`
+	Extra   map[string]int `json:"extra"`
+	Parent  *record        `json:"parent"`
+	Ignored string         `json:"-"`
+	Plain   bool
+	Any     interface{}       `json:"any"`
+	Nested  map[string]record `json:"nested"`
+}
+
+func TestDecodeStruct(t *testing.T) {
+	var r record
+	assertDecoded(t, `{
+		"name": "a", "age": 3, "tags": ["x", "y"], "extra": {"k": 1},
+		"parent": {"name": "p"}, "Ignored": "no", "plain": true, "any": [1, 1.5],
+		"nested": {"n": {"name": "n"}}, "unknown": 1
+	}`, &r)
+
+	equals(t, record{
+		Name:   "a",
+		Age:    3,
+		Tags:   []string{"x", "y"},
+		Extra:  map[string]int{"k": 1},
+		Parent: &record{Name: "p"},
+		Plain:  true,
+		Any:    []interface{}{1, 1.5},
+		Nested: map[string]record{"n": {Name: "n"}},
+	}, r)
+}
+
+func TestForEach(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJson(`[{"name": "a", "age": 1}, {"name": "b", "tags": ["x"]}]`))
+	var got []record
+	ok(t, ForEach(jq, func(r record) error {
+		got = append(got, r)
+		return nil
+	}))
+	equals(t, []record{{Name: "a", Age: 1}, {Name: "b", Tags: []string{"x"}}}, got)
+}
+
+func TestForEachErrors(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJson(`[1, "two", 3]`))
+	var got []int
+	err = ForEach(jq, func(n int) error {
+		got = append(got, n)
+		return nil
+	})
+	assert(t, err != nil, "expected a decoding error")
+	equals(t, []int{1}, got)
+	equals(t, false, jq.Next())
+
+	stop := errors.New("stop")
+	ok(t, jq.HandleJson(`[1, 2]`))
+	equals(t, stop, ForEach(jq, func(n int) error { return stop }))
+	equals(t, false, jq.Next())
+
+	ok(t, jq.HandleJson(`1`))
+	assert(t, ForEach(jq, func(n int) error { return nil }) != nil, "expected a runtime error")
+}
+
+func TestDecodeAll(t *testing.T) {
+	jq, err := NewJQ(`.[] | if . == "stop" then error("stopped") else . end`)
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJson(`[1, "two", 3, "four", 5]`))
+	got, errs := DecodeAll[int](jq, true)
+	equals(t, []int{1, 3, 5}, got)
+	equals(t, 2, len(errs))
+
+	ok(t, jq.HandleJson(`[1, "two", 3]`))
+	got, errs = DecodeAll[int](jq, false)
+	equals(t, []int{1}, got)
+	equals(t, 1, len(errs))
+	equals(t, false, jq.Next())
+
+	ok(t, jq.HandleJson(`[1, "two", "stop", 4]`))
+	got, errs = DecodeAll[int](jq, true)
+	equals(t, []int{1}, got)
+	equals(t, 2, len(errs))
+	equals(t, "stopped", errs[1].Error())
+}
+
+func TestDecodeSliceOfStructs(t *testing.T) {
+	var rs []record
+	assertDecoded(t, `[{"name": "a"}, {"name": "b", "age": 2}]`, &rs)
+	equals(t, []record{{Name: "a"}, {Name: "b", Age: 2}}, rs)
+}
+
+func TestDecodeArray(t *testing.T) {
+	arr := [3]int{9, 9, 9}
+	assertDecoded(t, `[1, 2]`, &arr)
+	equals(t, [3]int{1, 2, 0}, arr)
+}
+
+func TestDecodeNull(t *testing.T) {
+	r := &record{Name: "a"}
+	n := 5
+	ptr := &n
+	assertDecoded(t, `null`, &r)
+	assertDecoded(t, `null`, &ptr)
+	equals(t, (*record)(nil), r)
+	equals(t, (*int)(nil), ptr)
+}
+
+func TestDecodeIntKeys(t *testing.T) {
+	var m map[int]string
+	assertDecoded(t, `{"1": "a", "20": "b"}`, &m)
+	equals(t, map[int]string{1: "a", 20: "b"}, m)
+}
+
+func TestDecodeBytes(t *testing.T) {
+	var b []byte
+	assertDecoded(t, `"aGVsbG8="`, &b)
+	equals(t, []byte("hello"), b)
+}
+
+func TestDecodeNumber(t *testing.T) {
+	var n json.Number
+	assertDecoded(t, `1.5`, &n)
+	equals(t, json.Number("1.5"), n)
+}
+
+func TestDecodeBig(t *testing.T) {
+	var v struct {
+		Ptr   *big.Int
+		Int   big.Int
+		Float *big.Float
+	}
+	assertDecoded(t, `{"ptr": 1e30, "int": -12, "float": 0.5}`, &v)
+	equals(t, "1000000000000000000000000000000", v.Ptr.String())
+	equals(t, "-12", v.Int.String())
+	equals(t, "0.5", v.Float.String())
+
+	jv, err := parseJson(`1.5`)
+	ok(t, err)
+	defer freeJv(jv)
+	var n big.Int
+	_, isTypeErr := decodeInto(jv, &n, decodeOptions{}).(*json.UnmarshalTypeError)
+	equals(t, true, isTypeErr)
+}
+
+func TestWithBigNumbers(t *testing.T) {
+	jq, err := NewJQ(".", WithBigNumbers())
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJson(`[1, 1.5, -1e30, 100000000000000000000]`))
+	equals(t, true, jq.Next())
+	values := jq.Value().([]interface{})
+	equals(t, 1, values[0])
+	equals(t, 1.5, values[1])
+	equals(t, "-1000000000000000000000000000000", values[2].(*big.Int).String())
+	equals(t, "100000000000000000000", values[3].(*big.Int).String())
+
+	var decoded []interface{}
+	ok(t, jq.ValueInto(&decoded))
+	equals(t, "-1000000000000000000000000000000", decoded[2].(*big.Int).String())
+}
+
+func TestDecodeUnmarshaler(t *testing.T) {
+	var ts struct {
+		When time.Time `json:"when"`
+	}
+	assertDecoded(t, `{"when": "2020-01-02T03:04:05Z"}`, &ts)
+	equals(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), ts.When)
+}
+
+type Embedded struct {
+	ID    int `json:"id"`
+	Shade string
+}
+
+func TestDecodeEmbedded(t *testing.T) {
+	var v struct {
+		*Embedded
+		Name  string `json:"name"`
+		Shade string
+	}
+	assertDecoded(t, `{"id": 7, "name": "n", "shade": "top"}`, &v)
+	equals(t, 7, v.ID)
+	equals(t, "n", v.Name)
+	equals(t, "top", v.Shade)
+	equals(t, "", v.Embedded.Shade)
+}
+
+func TestDecodeQuoted(t *testing.T) {
+	var v struct {
+		N int  `json:"n,string"`
+		B bool `json:"b,string"`
+	}
+	assertDecoded(t, `{"n": "42", "b": "true"}`, &v)
+	equals(t, 42, v.N)
+	equals(t, true, v.B)
+}
+
+func TestDecodeTypeError(t *testing.T) {
+	jv, err := parseJson(`{"name": 1, "age": 2}`)
+	ok(t, err)
+	defer freeJv(jv)
+
+	var r record
+	err = decodeInto(jv, &r, decodeOptions{})
+	typeErr, isTypeErr := err.(*json.UnmarshalTypeError)
+	assert(t, isTypeErr, "expected an UnmarshalTypeError, got %v", err)
+	equals(t, "name", typeErr.Field)
+	equals(t, "number", typeErr.Value)
+
+	// decoding carries on past the mismatch, like encoding/json
+	equals(t, 2, r.Age)
+}
+
+func TestDecodeFractionToInt(t *testing.T) {
+	jv, err := parseJson(`1.5`)
+	ok(t, err)
+	defer freeJv(jv)
+
+	var n int
+	err = decodeInto(jv, &n, decodeOptions{})
+	assert(t, err != nil && strings.Contains(err.Error(), "number 1.5"), "unexpected error: %v", err)
+}
+
+func TestDecodeNonPointer(t *testing.T) {
+	jv, err := parseJson(`1`)
+	ok(t, err)
+	defer freeJv(jv)
+
+	var n int
+	_, isInvalid := decodeInto(jv, n, decodeOptions{}).(*json.InvalidUnmarshalError)
+	equals(t, true, isInvalid)
+}
+
+func TestValueInto(t *testing.T) {
+	jq, err := NewJQ(".items[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`{"items": [{"name": "a", "tags": ["t"]}]}`)
+	equals(t, true, jq.Next())
+	var r record
+	ok(t, jq.ValueInto(&r))
+	equals(t, record{Name: "a", Tags: []string{"t"}}, r)
+}
+
+func TestValueDecode(t *testing.T) {
+	v := parsedValue(t, `[{"name": "a"}]`)
+	defer v.Free()
+
+	var rs []record
+	ok(t, v.Decode(&rs))
+	equals(t, []record{{Name: "a"}}, rs)
+}
+
+type patch struct {
+	Name  *string `json:"name"`
+	Age   int     `json:"age"`
+	Email string  `json:"email"`
+	Tags  []struct {
+		ID *int `json:"id"`
+	} `json:"tags"`
+}
+
+func TestValueIntoWithPresence(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`{"name": null, "age": 3, "tags": [{"id": null}, {}], "x y": {"z": 1}}`)
+	equals(t, true, jq.Next())
+
+	var p patch
+	presence, err := jq.ValueIntoWithPresence(&p)
+	ok(t, err)
+
+	equals(t, (*string)(nil), p.Name)
+	equals(t, 3, p.Age)
+	equals(t, true, presence.Has(".name"))
+	equals(t, true, presence.Has(".age"))
+	equals(t, false, presence.Has(".email"))
+	equals(t, true, presence.Has(".tags[0].id"))
+	equals(t, false, presence.Has(".tags[1].id"))
+	equals(t, true, presence.Has(`.["x y"].z`))
+}
+
+func TestDecodeWithPresenceError(t *testing.T) {
+	v := parsedValue(t, `{"age": "old"}`)
+	defer v.Free()
+
+	var p patch
+	presence, err := v.DecodeWithPresence(&p)
+	assert(t, err != nil, "expected a type error")
+	equals(t, Presence(nil), presence)
+}
@@ -0,0 +1,64 @@
+package jq
+
+// #include <jq.h>
+// #include <jv.h>
+import "C"
+
+// Error is a runtime error raised by a jq program, returned by Err after
+// Next reports the end of the output. It is tagged so that it can be logged
+// as a JSON object.
+type Error struct {
+	// Message is the error's payload as text: the payload itself if it is
+	// a string, or else its JSON encoding.
+	Message string `json:"message"`
+	// Value is the payload decoded as by Value. Most built in errors carry a
+	// string, but error/1 and halt_error can raise any value.
+	Value interface{} `json:"value"`
+	// Halted is set when the program stopped by calling halt_error, in
+	// which case ExitCode holds the exit code it asked for.
+	Halted   bool `json:"halted,omitempty"`
+	ExitCode int  `json:"exit_code,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// runtimeError converts the invalid jv that ended the output into an error,
+// taking the payload from halt_error if the program halted. It returns nil
+// if the output simply ran out, or the program called halt.
+func (jq *JQ) runtimeError(jv C.jv) error {
+	if C.jq_halted(jq.state) == 0 {
+		if C.jv_invalid_has_msg(C.jv_copy(jv)) == 0 {
+			return nil
+		}
+		return newError(trackJv(C.jv_invalid_get_msg(C.jv_copy(jv))))
+	}
+
+	msg := C.jq_get_error_message(jq.state)
+	if !isValid(msg) {
+		// plain halt, which is a normal exit
+		freeJv(msg)
+		return nil
+	}
+	err := newError(msg)
+	err.Halted = true
+	code := C.jq_get_exit_code(jq.state)
+	if C.jv_get_kind(code) == C.JV_KIND_NUMBER {
+		err.ExitCode = int(C.jv_number_value(code))
+	}
+	freeJv(code)
+	return err
+}
+
+// newError takes ownership of payload.
+func newError(payload C.jv) *Error {
+	err := &Error{Value: jvToGo(payload)}
+	if C.jv_get_kind(payload) == C.JV_KIND_STRING {
+		err.Message = jvGoString(payload)
+	} else {
+		err.Message = dumpJson(payload)
+	}
+	freeJv(payload)
+	return err
+}
@@ -0,0 +1,63 @@
+package jq
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func runtimeErr(t *testing.T, program string) *Error {
+	t.Helper()
+	jq, err := NewJQ(program)
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	for jq.Next() {
+	}
+	jqErr, isJqErr := jq.Err().(*Error)
+	assert(t, isJqErr, "expected an *Error, got %#v", jq.Err())
+	return jqErr
+}
+
+func TestErrorString(t *testing.T) {
+	err := runtimeErr(t, `error("boom")`)
+	equals(t, &Error{Message: "boom", Value: "boom"}, err)
+	equals(t, "boom", err.Error())
+}
+
+func TestErrorObject(t *testing.T) {
+	err := runtimeErr(t, `error({code: 7, reason: "bad"})`)
+	equals(t, map[string]interface{}{"code": 7, "reason": "bad"}, err.Value)
+	equals(t, false, err.Halted)
+
+	var logged map[string]interface{}
+	b, jsonErr := json.Marshal(err)
+	ok(t, jsonErr)
+	ok(t, json.Unmarshal(b, &logged))
+	equals(t, map[string]interface{}{"code": 7.0, "reason": "bad"}, logged["value"])
+}
+
+func TestErrorHalt(t *testing.T) {
+	err := runtimeErr(t, `{detail: [1, 2]} | halt_error(3)`)
+	equals(t, &Error{
+		Message:  `{"detail":[1,2]}`,
+		Value:    map[string]interface{}{"detail": []interface{}{1, 2}},
+		Halted:   true,
+		ExitCode: 3,
+	}, err)
+
+	err = runtimeErr(t, `"stopped\n" | halt_error`)
+	equals(t, "stopped\n", err.Message)
+	equals(t, 5, err.ExitCode)
+}
+
+func TestHaltIsNotAnError(t *testing.T) {
+	jq, err := NewJQ(`1, halt, 2`)
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	all, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{1}, all)
+}
@@ -0,0 +1,102 @@
+package jq
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Filter is a jq program built from Go with the combinators below, e.g.
+//
+//	Pipe(Field("items"), Iterate(), Select(Eq(Field("kind"), Literal(kind))))
+//
+// Names and values are escaped as they are spliced in, so data from users
+// cannot change the program's meaning. Each combinator's operands are
+// parenthesized, so they compose without regard to jq's precedence rules.
+type Filter struct {
+	program string
+	err     error
+}
+
+// Identity is jq's `.`.
+func Identity() Filter {
+	return Filter{program: "."}
+}
+
+// Raw uses program as written, for parts of jq the combinators do not
+// cover. It is not escaped, so it must not contain untrusted text.
+func Raw(program string) Filter {
+	return Filter{program: program}
+}
+
+// Field is `.[name]`, the value of the key name.
+func Field(name string) Filter {
+	return Filter{program: ".[" + QuoteString(name) + "]"}
+}
+
+// Index is `.[i]`, the i'th element of an array, counting from the end if
+// i is negative.
+func Index(i int) Filter {
+	return Filter{program: ".[" + strconv.Itoa(i) + "]"}
+}
+
+// Iterate is `.[]`, each element of an array or value of an object.
+func Iterate() Filter {
+	return Filter{program: ".[]"}
+}
+
+// Literal is v, converted as Handle converts its input, as a constant.
+func Literal(v interface{}) Filter {
+	jv := trackJv(newEncoder(0).encode(v))
+	defer freeJv(jv)
+	if !isValid(jv) {
+		return Filter{err: invalidError(jv)}
+	}
+	return Filter{program: dumpJson(jv)}
+}
+
+// Pipe is `a | b | ...`, each filter run on the outputs of the one before.
+// With no filters it is Identity.
+func Pipe(filters ...Filter) Filter {
+	if len(filters) == 0 {
+		return Identity()
+	}
+	return join(filters, " | ")
+}
+
+// Select is `select(cond)`, passing on its input when cond is truthy.
+func Select(cond Filter) Filter {
+	if cond.err != nil {
+		return cond
+	}
+	return Filter{program: "select(" + cond.program + ")"}
+}
+
+// Eq is `a == b`.
+func Eq(a, b Filter) Filter {
+	return join([]Filter{a, b}, " == ")
+}
+
+// String returns the program text.
+func (f Filter) String() string {
+	return f.program
+}
+
+// Compile compiles the filter with NewJQ, or returns the error from
+// building it, e.g. a Literal that could not be converted.
+func (f Filter) Compile(opts ...Option) (*JQ, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return NewJQ(f.program, opts...)
+}
+
+func join(filters []Filter, sep string) Filter {
+	parts := make([]string, len(filters))
+	for i, f := range filters {
+		if f.err != nil {
+			return f
+		}
+		parts[i] = "(" + f.program + ")"
+	}
+	return Filter{program: strings.Join(parts, sep)}
+}
@@ -0,0 +1,50 @@
+package jq
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	f := Pipe(Field("items"), Iterate(), Select(Eq(Field("kind"), Literal("a"))), Field("id"))
+	equals(t, `(.["items"]) | (.[]) | (select((.["kind"]) == ("a"))) | (.["id"])`, f.String())
+
+	jq, err := f.Compile()
+	ok(t, err)
+	defer jq.Close()
+	jq.HandleJson(`{"items": [{"kind": "a", "id": 1}, {"kind": "b", "id": 2}, {"kind": "a", "id": 3}]}`)
+	results, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{1, 3}, results)
+
+	jq, err = Pipe(Index(-1), Index(0)).Compile()
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle([][]int{{1, 2}, {3, 4}})
+	results, err = jq.All()
+	ok(t, err)
+	equals(t, []interface{}{3}, results)
+}
+
+func TestFilterEscaping(t *testing.T) {
+	key := `") | env | ("`
+	jq, err := Pipe(Field(key), Select(Eq(Identity(), Literal(map[string]string{"$x": `\(env)`})))).Compile()
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle(map[string]interface{}{key: map[string]string{"$x": `\(env)`}})
+	results, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{map[string]interface{}{"$x": `\(env)`}}, results)
+
+	jq, err = Pipe(Raw(". as $x | $x"), Raw("., 2")).Compile()
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle(1)
+	results, err = jq.All()
+	ok(t, err)
+	equals(t, []interface{}{1, 2}, results)
+}
+
+func TestFilterLiteralError(t *testing.T) {
+	_, err := Pipe(Identity(), Select(Eq(Identity(), Literal(make(chan int))))).Compile()
+	assert(t, err != nil, "expected an error converting the literal")
+}
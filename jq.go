@@ -3,37 +3,211 @@ package jq
 // #cgo LDFLAGS: -ljq
 // #include <jq.h>
 // #include <jv.h>
+// #include <stdint.h>
 // #include <stdlib.h>
+//
+// extern void goJqErrorCallback(void *, jv);
+// extern jv goJqInputCallback(jq_state *, void *);
+//
+// static void set_error_cb(jq_state *jq, uintptr_t handle) {
+//   jq_set_error_cb(jq, goJqErrorCallback, (void *)handle);
+// }
+//
+// static void set_input_cb(jq_state *jq, uintptr_t handle) {
+//   jq_set_input_cb(jq, goJqInputCallback, (void *)handle);
+// }
+//
+// // array_get_borrowed is jv_array_get without the reference counting: the
+// // array keeps the element alive, so it is valid for as long as the array is.
+// static jv array_get_borrowed(jv a, int i) {
+//   jv item = jv_array_get(jv_copy(a), i);
+//   jv_free(item);
+//   return item;
+// }
 import "C"
 import (
+	"bytes"
+	"encoding"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"path/filepath"
 	"reflect"
+	"runtime/cgo"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
 type JQ struct {
-	program    string
-	state      *C.jq_state
-	lastValue  C.jv
-	prevRefCnt int
+	program   string
+	state     *C.jq_state
+	handle    cgo.Handle
+	lastValue C.jv
+	input     C.jv
+	finished  bool
+	err       error
+	sortKeys  bool
+	output    OutputOptions
+	maxDepth  int
+
+	// largest output allowed, in bytes of compact JSON, if positive
+	maxOutputSize int
+
+	rejectDuplicateKeys bool
+
+	// whether SetAttr has been called, which cannot be undone
+	attrsChanged bool
+
+	// output the input in place of a runtime error
+	passthrough bool
+
+	// how Value and ValueInto convert strings and numbers
+	decode decodeOptions
+
+	// where HandleFrom takes inputs from, until it runs out
+	source func() (interface{}, bool)
+
+	// where the input and inputs builtins read from, if anywhere, and how
+	// many values they have taken for the current input
+	inputs     *jsonStream
+	inputsRead int
+
+	observer Observer
+	stats    inputStats
+	recorder *inputRecorder
+
+	// set from other goroutines by Cancel
+	cancelled atomic.Bool
+
+	// named arguments bound when the program is compiled
+	args map[string]interface{}
+
+	// names the program may not use
+	denylist map[string]bool
+
+	// the time zone set while the program runs, if any
+	timezone string
+
+	// messages reported through jq's error callback, e.g. compile errors
+	errorMessages []string
+
+	// where the stderr builtin's output goes, once jq's callback is set
+	stderrHandler func(raw string)
+	stderrHooked  bool
 }
 
-func NewJQ(program string) (*JQ, error) {
-	state := C.jq_init()
-	jq := &JQ{program, state, C.jv_invalid(), 0}
-	if err := jq.compile(program); err != nil {
+// NewJQ compiles program with the given options. An empty or all whitespace
+// program is the identity filter, as it is for the jq command line tool.
+func NewJQ(program string, opts ...Option) (*JQ, error) {
+	jq := &JQ{program: program, state: C.jq_init(), lastValue: C.jv_invalid(), input: C.jv_invalid(), finished: true}
+	jq.handle = cgo.NewHandle(jq)
+	openInstance()
+	C.set_error_cb(jq.state, C.uintptr_t(jq.handle))
+	C.set_input_cb(jq.state, C.uintptr_t(jq.handle))
+	for _, opt := range opts {
+		if err := opt(jq); err != nil {
+			jq.Close()
+			return nil, err
+		}
+	}
+	began := time.Now()
+	err := jq.compile(program)
+	if jq.observer != nil {
+		jq.observer.OnCompile(time.Since(began), err)
+	}
+	if err != nil {
 		jq.Close()
 		return nil, err
 	}
 	return jq, nil
 }
 
+// MustNewJQ is like NewJQ but panics if the program cannot be compiled. It
+// simplifies safe initialization of global variables holding filters.
+func MustNewJQ(program string, opts ...Option) *JQ {
+	jq, err := NewJQ(program, opts...)
+	if err != nil {
+		panic("jq: NewJQ(" + strconv.Quote(program) + "): " + err.Error())
+	}
+	return jq
+}
+
+// NewJQFromReader reads a program from r, such as a file opened from an
+// embed.FS, and compiles it with NewJQ. If r has a Name method giving its
+// path, as *os.File does, the program's origin is set to the file's
+// directory the way jq -f sets it, so get_prog_origin and imports with
+// {search: "./"} are relative to the file. Options can still override the
+// PROGRAM_ORIGIN attribute.
+func NewJQFromReader(r io.Reader, opts ...Option) (*JQ, error) {
+	program, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if named, ok := r.(interface{ Name() string }); ok {
+		if dir, err := filepath.Abs(filepath.Dir(named.Name())); err == nil {
+			opts = append([]Option{WithAttr("PROGRAM_ORIGIN", dir)}, opts...)
+		}
+	}
+	return NewJQ(string(program), opts...)
+}
+
+// Program returns the source text of the filter.
+func (jq *JQ) Program() string {
+	return jq.program
+}
+
+// String returns the source text of the filter, so instances identify
+// themselves when logged.
+func (jq *JQ) String() string {
+	return jq.program
+}
+
+// Handle starts the filter on a Go value. If the value cannot be converted
+// to JSON, for instance because it contains itself or is nested more deeply
+// than the limit set by SetMaxDepth, there are no outputs and Err reports
+// the problem.
+//
+// JSON has no NaN or infinities, so floats are converted the way jq prints
+// them: NaN becomes null and ±Inf the largest finite doubles. Value and
+// ValueInto treat those that jq's own nan and infinite produce the same way.
 func (jq *JQ) Handle(value interface{}) {
-	jq.start(goToJv(value))
+	jv := trackJv(newEncoder(jq.maxDepth).encode(value))
+	if !isValid(jv) {
+		jq.drain()
+		jq.forgetInput()
+		jq.err = invalidError(jv)
+		freeJv(jv)
+		if jq.observer != nil {
+			jq.observer.OnInput(0, 0, jq.err)
+		}
+		return
+	}
+	jq.start(jv)
+}
+
+// SetMaxDepth limits how deeply nested a value passed to Handle may be. The
+// default, also used for depth <= 0, is 10000 levels.
+func (jq *JQ) SetMaxDepth(depth int) {
+	jq.maxDepth = depth
 }
 
+// HandleJson parses text and starts the filter on it. The text must contain
+// a single JSON value; trailing data other than whitespace is rejected.
+//
+// Numbers are parsed by libjq. From jq 1.7 a number the program leaves
+// untouched is printed exactly as written, so 3.140 passes through . as
+// 3.140; jq 1.6 keeps only the double and prints 3.14.
 func (jq *JQ) HandleJson(text string) error {
+	if jq.rejectDuplicateKeys {
+		if dups, _ := scanDuplicateKeys(strings.NewReader(text), true); len(dups) > 0 {
+			return dups[0]
+		}
+	}
 	jv, err := parseJson(text)
 
 	if err == nil {
@@ -44,105 +218,560 @@ func (jq *JQ) HandleJson(text string) error {
 	}
 }
 
+// HandleJsonBytes is like HandleJson but parses the bytes in place, without
+// converting them to a string first.
+func (jq *JQ) HandleJsonBytes(text []byte) error {
+	if jq.rejectDuplicateKeys {
+		if dups, _ := scanDuplicateKeys(bytes.NewReader(text), true); len(dups) > 0 {
+			return dups[0]
+		}
+	}
+	jv, err := parseJsonBytes(text)
+
+	if err == nil {
+		jq.start(jv)
+		return nil
+	} else {
+		return err
+	}
+}
+
+// Next advances to the next output for the current input, or the inputs
+// given to HandleFrom, and reports whether there is one. A null output is
+// an output like any other: Next returns true for it and Value returns
+// nil. Next returns false only once the outputs have run out or the
+// program has failed, and Err tells those apart, so a nil Value never
+// means the end.
 func (jq *JQ) Next() bool {
-	// jq.ValueJson() is self execute internally (jv_dump_term in the jv_dump_string)
-	if jq.prevRefCnt == jq.jv_get_refcnt() {
+	for {
+		if jq.nextOutput() {
+			return true
+		}
+		if jq.err != nil || jq.source == nil || !jq.pullSource() {
+			return false
+		}
+	}
+}
+
+// HandleFrom runs the filter over each value next returns, until it
+// returns false, pulling the values lazily so that inputs from a database
+// cursor or a channel need not be gathered into a slice. Next steps
+// through the outputs of one input after another as if they were one
+// stream, calling next whenever an input's outputs run out; the first
+// error stops the stream.
+//
+// The source is dropped once next returns false, when Handle or another
+// call starts a different input, and when outputs are abandoned, e.g. by
+// Reset or AllN.
+func (jq *JQ) HandleFrom(next func() (interface{}, bool)) {
+	jq.drain()
+	jq.forgetInput()
+	jq.err = nil
+	jq.source = next
+}
+
+// pullSource starts the filter on the source's next value, reporting
+// whether there was one.
+func (jq *JQ) pullSource() bool {
+	next := jq.source
+	value, ok := next()
+	if !ok {
+		jq.source = nil
+		return false
+	}
+	jq.Handle(value)
+	jq.source = next
+	return true
+}
+
+func (jq *JQ) nextOutput() bool {
+	if jq.finished {
+		return false
+	}
+	if jq.cancelled.Swap(false) {
+		jq.err = ErrCancelled
+		jq.endInput(jq.err)
+		jq.drain()
+		return false
+	}
+	freeJv(jq.lastValue)
+	if jq.observer != nil {
+		began := time.Now()
+		jq.lastValue = jq.next()
+		jq.stats.busy += time.Since(began)
+	} else {
+		jq.lastValue = jq.next()
+	}
+	if isValid(jq.lastValue) {
+		if jq.maxOutputSize > 0 {
+			if err := jq.checkOutputSize(); err != nil {
+				jq.err = err
+				jq.endInput(err)
+				jq.drain()
+				return false
+			}
+		}
+		jq.stats.outputs++
+		return true
+	}
+	jq.finished = true
+	err := jq.runtimeError(jq.lastValue)
+	jq.endInput(err)
+	if err != nil && jq.passthrough && isValid(jq.input) {
 		freeJv(jq.lastValue)
+		jq.lastValue = C.jv_copy(jq.input)
+		return true
 	}
-	jq.lastValue = jq.next()
-	jq.prevRefCnt = jq.jv_get_refcnt()
-	return isValid(jq.lastValue)
+	jq.err = err
+	return false
+}
+
+// Rerun restarts the filter over the most recently handled input, without
+// encoding or parsing it again. To make this possible a reference to each
+// input is kept until the next one is handled or the JQ is closed, so the
+// memory used by a large input is not released while the filter is idle.
+func (jq *JQ) Rerun() error {
+	if !isValid(jq.input) {
+		return errors.New("No input to rerun")
+	}
+	jq.drain()
+	jq.start(C.jv_copy(jq.input))
+	return nil
+}
+
+// ErrCancelled is reported by Err when Cancel stopped the outputs.
+var ErrCancelled = errors.New("Filter cancelled")
+
+// Cancel stops the outputs for the current input: the next call to Next
+// returns false and Err returns ErrCancelled. It is safe to call from any
+// goroutine, e.g. a signal handler. Cancellation is cooperative, jq cannot
+// be interrupted while it works towards an output, so it only takes effect
+// between outputs. Handling a new input clears a pending Cancel.
+func (jq *JQ) Cancel() {
+	jq.cancelled.Store(true)
+}
+
+// Reset abandons any remaining outputs and the error from the current input,
+// leaving the compiled filter ready for the next Handle. Handling a new input
+// does the same implicitly; Reset is for releasing the current output early.
+func (jq *JQ) Reset() {
+	jq.drain()
+	jq.err = nil
+}
+
+// All returns every remaining output for the current input. If the program
+// fails part way through, the outputs it produced before the error are
+// returned along with it.
+func (jq *JQ) All() ([]interface{}, error) {
+	var results []interface{}
+	for jq.Next() {
+		results = append(results, jq.Value())
+	}
+	return results, jq.Err()
+}
+
+// ErrNoOutputs is returned by AtLeastOne when the program produced nothing.
+var ErrNoOutputs = errors.New("Expected at least one output, got none")
+
+// AtLeastOne is like All but returns ErrNoOutputs if the program produces
+// no outputs for the current input, for filters such as lookups where an
+// empty result means something is misconfigured.
+func (jq *JQ) AtLeastOne() ([]interface{}, error) {
+	results, err := jq.All()
+	if err == nil && len(results) == 0 {
+		return nil, ErrNoOutputs
+	}
+	return results, err
+}
+
+// Single returns the only remaining output for the current input. It is an
+// error for the filter to produce no outputs or more than one; in the
+// latter case the rest are discarded.
+func (jq *JQ) Single() (interface{}, error) {
+	if !jq.Next() {
+		if err := jq.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("Expected one output, got none")
+	}
+	value := jq.Value()
+	if jq.Next() {
+		jq.drain()
+		return nil, errors.New("Expected one output, got more than one")
+	}
+	if err := jq.Err(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Matches runs the filter on input and reports whether it produced a truthy
+// output, that is anything other than false or null, as select would. It
+// stops at the first truthy output and discards the rest. An error before
+// then is returned with false.
+func (jq *JQ) Matches(input interface{}) (bool, error) {
+	jq.Handle(input)
+	for jq.Next() {
+		if kind := C.jv_get_kind(jq.lastValue); kind != C.JV_KIND_FALSE && kind != C.JV_KIND_NULL {
+			jq.drain()
+			return true, nil
+		}
+	}
+	return false, jq.Err()
+}
+
+// AllMatch reports whether every one of inputs matches, as Matches decides,
+// stopping at the first that does not. No inputs match vacuously. The
+// first error is returned with false.
+func (jq *JQ) AllMatch(inputs []interface{}) (bool, error) {
+	for _, input := range inputs {
+		if matched, err := jq.Matches(input); !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// AnyMatch reports whether any of inputs matches, as Matches decides,
+// stopping at the first that does. The first error is returned with false.
+func (jq *JQ) AnyMatch(inputs []interface{}) (bool, error) {
+	for _, input := range inputs {
+		matched, err := jq.Matches(input)
+		if matched || err != nil {
+			return matched, err
+		}
+	}
+	return false, nil
+}
+
+// AllN is like All but stops after n outputs, discarding any the filter
+// would have produced after that. It is a safety valve for filters that
+// generate unbounded streams. Like All it returns the outputs produced
+// before any error along with the error.
+func (jq *JQ) AllN(n int) ([]interface{}, error) {
+	var results []interface{}
+	for len(results) < n && jq.Next() {
+		results = append(results, jq.Value())
+	}
+	if !jq.finished {
+		jq.drain()
+		return results, nil
+	}
+	return results, jq.Err()
+}
+
+// Err returns the error that stopped the last call to Next, or nil if the
+// filter simply ran out of outputs.
+//
+// An error the program does not catch ends its outputs for that input:
+// libjq cannot carry on past one (asking it to aborts the process), so
+// there is no mode that skips failed outputs and keeps going. To tolerate
+// partial data, catch errors inside the program where they happen instead,
+// e.g. `.[] | .field?` or `.[] | try f catch empty`, or compile with
+// OnErrorPassthrough to output the input in place of the error.
+func (jq *JQ) Err() error {
+	return jq.err
+}
+
+// InputsRead returns how many values the input and inputs builtins have
+// taken from the reader given to WithInputs since the current input was
+// handled. It is for information only: values are read ahead in large
+// chunks, so the reader has been consumed beyond the values counted and
+// there is no position in it to resume from.
+func (jq *JQ) InputsRead() int {
+	return jq.inputsRead
 }
 
 func (jq *JQ) Value() interface{} {
-	return jvToGo(jq.lastValue)
+	return jvToGoKind(jq.lastValue, C.jv_get_kind(jq.lastValue), jq.decode)
+}
+
+// ValueKind returns the jq type name of the current output, as given by jq's
+// type builtin: "null", "boolean", "number", "string", "array" or "object".
+func (jq *JQ) ValueKind() string {
+	return kindName(C.jv_get_kind(jq.lastValue))
+}
+
+// ValueTyped returns the current output together with its jq type name, for
+// consumers dispatching on the type of each output. It costs one fewer call
+// into jq than calling Value and ValueKind separately.
+func (jq *JQ) ValueTyped() (interface{}, string) {
+	kind := C.jv_get_kind(jq.lastValue)
+	return jvToGoKind(jq.lastValue, kind, jq.decode), kindName(kind)
 }
 
 func (jq *JQ) ValueJson() string {
-	return dumpJson(jq.lastValue)
+	if jq.output.CanonicalNumbers || jq.output.TrailingNewline {
+		return string(jq.AppendValueJson(nil))
+	}
+	return dumpJsonFlags(jq.lastValue, jq.dumpFlags())
+}
+
+// AppendValueJson appends the compact JSON encoding of the current output to
+// dst and returns the extended buffer, like the strconv.Append functions.
+func (jq *JQ) AppendValueJson(dst []byte) []byte {
+	dst = jq.appendValueJson(dst)
+	if jq.output.TrailingNewline {
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// ValueJsonDebug is a diagnostic aid for chasing reference counting bugs,
+// not a serialization. It returns the current output as jq dumps it with
+// JV_PRINT_REFCOUNT: compact JSON with each string, array and object
+// followed by its reference count in parentheses, e.g. ["s" (1)] (2). The
+// outermost count includes the reference the dump itself takes. With no
+// current output it returns <invalid>.
+func (jq *JQ) ValueJsonDebug() string {
+	return dumpJsonFlags(jq.lastValue, C.JV_PRINT_REFCOUNT|C.JV_PRINT_INVALID)
 }
 
 func (jq *JQ) ValueString() string {
 	if C.jv_get_kind(jq.lastValue) == C.JV_KIND_STRING {
-		result := C.GoString(C.jv_string_value(jq.lastValue))
-		freeJv(jq.lastValue)
-		return result
+		if jq.output.TrailingNewline {
+			return jvGoString(jq.lastValue) + "\n"
+		}
+		return jvGoString(jq.lastValue)
 	} else {
-		return dumpJson(jq.lastValue)
+		return jq.ValueJson()
 	}
 }
 
+// SetSortKeys chooses the key ordering policy for objects produced by the
+// filter. When enabled, object keys are emitted in sorted order, like
+// `jq -S`; otherwise they keep the order in which the filter built them.
+// Value returns Go maps, which have no ordering, so the policy only shows
+// up in the JSON forms of the output and in Value.Keys.
+func (jq *JQ) SetSortKeys(sort bool) {
+	jq.sortKeys = sort
+}
+
 func (jq *JQ) Close() {
+	jq.endInput(nil)
 	freeJv(jq.lastValue)
 	jq.lastValue = C.jv_invalid()
+	jq.forgetInput()
+	if jq.inputs != nil {
+		jq.inputs.close()
+		jq.inputs = nil
+	}
 	jq.teardown()
 }
 
 // JQ APIs
 
 func (jq *JQ) compile(program string) error {
+	if err := jq.checkDenylist(program); err != nil {
+		return err
+	}
+	args, err := jq.compileArgs()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(program) == "" {
+		// jq's grammar accepts this as identity, but don't depend on it
+		program = "."
+	}
 	cs := C.CString(program)
 	defer C.free(unsafe.Pointer(cs))
-	if rc := C.jq_compile(jq.state, C.CString(program)); rc == 0 {
-		return errors.New("Unable to compile jq filter")
+	jq.errorMessages = nil
+	if rc := C.jq_compile_args(jq.state, cs, args); rc == 0 {
+		if len(jq.errorMessages) == 0 {
+			return errors.New("Unable to compile jq filter")
+		}
+		return errors.New("Unable to compile jq filter: " + strings.Join(jq.errorMessages, "; "))
 	} else {
 		return nil
 	}
 }
 
 func (jq *JQ) start(jv C.jv) {
-	C.jq_start(jq.state, jv, 0)
+	jq.source = nil
+	jq.err = nil
+	jq.finished = false
+	jq.cancelled.Store(false)
+	jq.inputsRead = 0
+	jq.forgetInput()
+	jq.input = C.jv_copy(jv)
+	jq.endInput(nil)
+	jq.recorder.record(jv)
+	if jq.observer != nil {
+		began := time.Now()
+		C.jq_start(jq.state, jv, 0)
+		jq.stats = inputStats{active: true, busy: time.Since(began)}
+	} else {
+		C.jq_start(jq.state, jv, 0)
+	}
+}
+
+// forgetInput releases the reference to the input kept for Rerun.
+func (jq *JQ) forgetInput() {
+	freeJv(jq.input)
+	jq.input = C.jv_invalid()
+}
+
+// drain abandons the remaining outputs for the current input. The filter is
+// not run to completion, since it may never finish; jq releases whatever it
+// was holding when the next input starts or the instance is torn down.
+func (jq *JQ) drain() {
+	jq.source = nil
+	jq.endInput(nil)
+	freeJv(jq.lastValue)
+	jq.lastValue = C.jv_invalid()
+	jq.finished = true
 }
 
 func (jq *JQ) next() C.jv {
+	if jq.timezone != "" {
+		defer useTimezone(jq.timezone)()
+	}
 	return C.jq_next(jq.state)
 }
 
 func (jq *JQ) teardown() {
 	C.jq_teardown(&jq.state)
-}
-
-func (jq *JQ) jv_get_refcnt() int {
-	return (int)(C.jv_get_refcnt(jq.lastValue))
+	jq.handle.Delete()
+	closeInstance()
 }
 
 // JSON values
 
 func parseJson(value string) (C.jv, error) {
-	cs := C.CString(value)
-	v := C.jv_parse(cs)
+	return parseJsonSized(unsafe.Pointer(unsafe.StringData(value)), len(value))
+}
+
+func parseJsonBytes(value []byte) (C.jv, error) {
+	return parseJsonSized(unsafe.Pointer(unsafe.SliceData(value)), len(value))
+}
+
+// parseJsonSized parses exactly n bytes, so the text needs no terminator and
+// an embedded NUL is a syntax error rather than the end of the input. jq
+// copies what it needs, so the text may live in Go memory.
+//
+// The text must hold exactly one value: anything but whitespace after it,
+// including a second value, is an error.
+func parseJsonSized(text unsafe.Pointer, n int) (C.jv, error) {
+	v := trackJv(C.jv_parse_sized((*C.char)(text), C.int(n)))
 	if C.jv_is_valid(v) == 0 {
-		return C.jv_null(), errors.New("Invalid JSON")
+		err := invalidError(v)
+		freeJv(v)
+		if err == nil {
+			return C.jv_null(), errors.New("Invalid JSON")
+		}
+		// jq appends the whole input to the message, which is no use for
+		// large documents
+		msg, _, _ := strings.Cut(err.Error(), " (while parsing '")
+		return C.jv_null(), errors.New("Invalid JSON: " + msg)
 	}
-	C.free(unsafe.Pointer(cs))
 	return v, nil
 }
 
 func dumpJson(jv C.jv) string {
-	strJv := C.jv_dump_string(jv, 0)
-	cresult := C.jv_string_value(strJv)
-	result := C.GoString(cresult)
+	return dumpJsonFlags(jv, 0)
+}
+
+// dumpJsonFlags leaves the reference to jv with the caller; jv_dump_string
+// consumes its argument so it is handed a copy.
+func dumpJsonFlags(jv C.jv, flags C.int) string {
+	strJv := trackJv(C.jv_dump_string(C.jv_copy(jv), flags))
+	result := jvGoString(strJv)
 	freeJv(strJv)
 	return result
 }
 
+func appendJsonFlags(dst []byte, jv C.jv, flags C.int) []byte {
+	strJv := trackJv(C.jv_dump_string(C.jv_copy(jv), flags))
+	dst = append(dst, jvStringBytes(strJv)...)
+	freeJv(strJv)
+	return dst
+}
+
+// jvStringBytes returns the bytes of a string jv without copying them. The
+// slice points into jq's memory and is only valid until the jv is freed.
+func jvStringBytes(str C.jv) []byte {
+	n := C.jv_string_length_bytes(C.jv_copy(str))
+	return unsafe.Slice((*byte)(unsafe.Pointer(C.jv_string_value(str))), int(n))
+}
+
+// jvGoString copies a string jv into Go. Unlike C.GoString it uses the
+// string's length, so embedded NUL bytes survive.
+func jvGoString(str C.jv) string {
+	return string(jvStringBytes(str))
+}
+
+// refcount does not count the reference held by the leak tracker, if any.
 func refcount(jv C.jv) int {
-	return int(C.jv_get_refcnt(jv))
+	return int(C.jv_get_refcnt(jv)) - trackerRefs(jv)
 }
 
 func jvString(value string) C.jv {
 	cs := C.CString(value)
-	result := C.jv_string(cs)
+	result := trackJv(C.jv_string_sized(cs, C.int(len(value))))
 	C.free(unsafe.Pointer(cs))
 	return result
 }
 
 func goToJv(v interface{}) C.jv {
+	return trackJv(newEncoder(0).encode(v))
+}
+
+const (
+	defaultMaxDepth = 10000
+
+	// like encoding/json, only pay for cycle detection on deep values
+	startDetectingCyclesAfter = 1000
+)
+
+// encoder converts Go values to jv. Failures are returned as an invalid jv
+// carrying the error message, so they can be reported through Err.
+type encoder struct {
+	maxDepth int
+	depth    int
+	visiting map[containerKey]struct{}
+
+	// build objects from Go maps with string keys in sorted order, rather
+	// than the map's random order
+	sortMapKeys bool
+}
+
+func newEncoder(maxDepth int) *encoder {
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxDepth
+	}
+	return &encoder{maxDepth: maxDepth}
+}
+
+// containerKey identifies a map or slice for cycle detection.
+type containerKey struct {
+	ptr uintptr
+	len int
+}
+
+func (e *encoder) encode(v interface{}) C.jv {
 	if v == nil {
 		return C.jv_null()
 	}
 
 	value := reflect.Indirect(reflect.ValueOf(v))
+	if !value.IsValid() {
+		return C.jv_null()
+	}
+
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > e.maxDepth {
+		return jvInvalidf("exceeded maximum depth of %d encoding %s", e.maxDepth, value.Type())
+	}
+
+	switch m := v.(type) {
+	case OrderedMap:
+		return e.encodeOrdered(m)
+	case Pairs:
+		return e.encodePairs(m)
+	case *Pairs:
+		return e.encodePairs(*m)
+	}
 
 	switch value.Type().Kind() {
 	case reflect.Bool:
@@ -153,40 +782,305 @@ func goToJv(v interface{}) C.jv {
 		}
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return C.jv_number(C.double(value.Int()))
-	// TODO reflect.Uintptr?
+	case reflect.Uintptr, reflect.UnsafePointer:
+		// addresses have no meaning outside this process
+		return jvInvalidf("%s cannot be encoded", value.Type())
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return C.jv_number(C.double(value.Uint()))
 	case reflect.Float32, reflect.Float64:
-		return C.jv_number(C.double(value.Float()))
+		return jvFloat(value.Float())
 	case reflect.String:
 		return jvString(value.String())
 	case reflect.Array, reflect.Slice:
+		if value.Kind() == reflect.Slice {
+			key := containerKey{value.Pointer(), value.Len()}
+			if !e.enter(key) {
+				return jvInvalidf("encountered a cycle via %s", value.Type())
+			}
+			defer e.leave(key)
+		}
 		n := value.Len()
 		arr := C.jv_array_sized(C.int(n))
 		for i := 0; i < n; i++ {
-			item := goToJv(value.Index(i).Interface())
+			item := e.encode(value.Index(i).Interface())
+			if !isValid(item) {
+				freeJv(arr)
+				return item
+			}
 			arr = C.jv_array_set(arr, C.int(i), item)
 		}
 		return arr
 	case reflect.Map:
-		// TODO assert key is string?
-		object := C.jv_object()
+		key := containerKey{value.Pointer(), 0}
+		if !e.enter(key) {
+			return jvInvalidf("encountered a cycle via %s", value.Type())
+		}
+		defer e.leave(key)
+		if !isMapKeyType(value.Type().Key()) {
+			return jvInvalidf("%s cannot be used as an object key", value.Type().Key())
+		}
+		keys := make([]namedKey, 0, value.Len())
 		for _, k := range value.MapKeys() {
-			key := goToJv(k.Interface())
-			mapValue := goToJv(value.MapIndex(k).Interface())
-			object = C.jv_object_set(object, key, mapValue)
+			name, err := mapKeyName(k)
+			if err != nil {
+				return jvInvalidf("%v", err)
+			}
+			keys = append(keys, namedKey{name, k})
+		}
+		if e.sortMapKeys {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+		}
+		object := C.jv_object()
+		for _, k := range keys {
+			mapValue := e.encode(value.MapIndex(k.value).Interface())
+			if !isValid(mapValue) {
+				freeJv(object)
+				return mapValue
+			}
+			object = C.jv_object_set(object, jvString(k.name), mapValue)
 		}
 		return object
 	}
 
-	msg := fmt.Sprintf("unknown type for: %v", value.Interface())
+	return jvInvalidf("unknown type for: %v", value.Interface())
+}
+
+type namedKey struct {
+	name  string
+	value reflect.Value
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// isMapKeyType reports whether encoding/json accepts t as a map key type:
+// strings, integers and encoding.TextMarshalers. Interface keys, as YAML
+// decoders produce, are checked one by one instead.
+func isMapKeyType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return t.Implements(textMarshalerType)
+}
+
+// mapKeyName returns the object key for a map key, chosen as encoding/json
+// chooses it.
+func mapKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.Interface {
+		if k.IsNil() {
+			return "", errors.New("nil cannot be used as an object key")
+		}
+		k = k.Elem()
+		if !isMapKeyType(k.Type()) {
+			return "", fmt.Errorf("%s cannot be used as an object key", k.Type())
+		}
+	}
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Pointer && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		if err != nil {
+			return "", fmt.Errorf("%s key: %v", k.Type(), err)
+		}
+		return string(text), nil
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	default:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+}
+
+// OrderedMap is implemented by map types that keep their keys in order,
+// such as github.com/iancoleman/orderedmap's. Handle and the other encoding
+// paths build objects from them with the keys in the order Keys returns,
+// where the keys of a Go map come out in random order.
+type OrderedMap interface {
+	Keys() []string
+	Get(key string) (interface{}, bool)
+}
+
+func (e *encoder) encodeOrdered(m OrderedMap) C.jv {
+	object := C.jv_object()
+	for _, k := range m.Keys() {
+		v, _ := m.Get(k)
+		mapValue := e.encode(v)
+		if !isValid(mapValue) {
+			freeJv(object)
+			return mapValue
+		}
+		object = C.jv_object_set(object, jvString(k), mapValue)
+	}
+	return object
+}
+
+// Pairs builds a jq object with its keys in the order given, for when the
+// output must follow a fixed field order. If a key appears more than once
+// the last value wins, in the place of the first.
+type Pairs []Pair
+
+// Pair is one key and value of Pairs.
+type Pair struct {
+	Key   string
+	Value interface{}
+}
+
+func (e *encoder) encodePairs(pairs Pairs) C.jv {
+	key := containerKey{reflect.ValueOf(pairs).Pointer(), len(pairs)}
+	if !e.enter(key) {
+		return jvInvalidf("encountered a cycle via %T", pairs)
+	}
+	defer e.leave(key)
+	object := C.jv_object()
+	for _, pair := range pairs {
+		value := e.encode(pair.Value)
+		if !isValid(value) {
+			freeJv(object)
+			return value
+		}
+		object = C.jv_object_set(object, jvString(pair.Key), value)
+	}
+	return object
+}
 
-	return C.jv_invalid_with_msg(jvString(msg))
+// enter records that the container identified by key is being encoded. It
+// returns false if it already was further up, meaning the value contains
+// itself.
+func (e *encoder) enter(key containerKey) bool {
+	if e.depth <= startDetectingCyclesAfter || key.ptr == 0 {
+		return true
+	}
+	if e.visiting == nil {
+		e.visiting = make(map[containerKey]struct{})
+	}
+	if _, ok := e.visiting[key]; ok {
+		return false
+	}
+	e.visiting[key] = struct{}{}
+	return true
 }
+
+func (e *encoder) leave(key containerKey) {
+	delete(e.visiting, key)
+}
+
+func jvInvalidf(format string, args ...interface{}) C.jv {
+	return C.jv_invalid_with_msg(jvString(fmt.Sprintf(format, args...)))
 }
 
 func jvToGo(value C.jv) interface{} {
-	switch C.jv_get_kind(value) {
+	return jvToGoKind(value, C.jv_get_kind(value), decodeOptions{})
+}
+
+// decodeOptions are the settings that change how jq values become Go ones.
+type decodeOptions struct {
+	// applied to every string, including object keys, if set
+	normalize func(string) string
+	// decode numbers int and float64 cannot hold exactly as math/big types
+	bigNumbers bool
+}
+
+func (o decodeOptions) string(s string) string {
+	if o.normalize == nil {
+		return s
+	}
+	return o.normalize(s)
+}
+
+// jvToGoKind is jvToGo for when the caller already knows the value's kind.
+// Nested arrays and objects are walked with an explicit stack rather than
+// by recursion, so the depth of a value the program builds is limited only
+// by memory.
+func jvToGoKind(value C.jv, kind C.jv_kind, opts decodeOptions) interface{} {
+	if kind != C.JV_KIND_ARRAY && kind != C.JV_KIND_OBJECT {
+		return scalarToGo(value, kind, opts)
+	}
+
+	stack := []decodeFrame{newDecodeFrame(value, kind)}
+	for {
+		f := &stack[len(stack)-1]
+		if item, ok := f.next(opts); ok {
+			if itemKind := C.jv_get_kind(item); itemKind == C.JV_KIND_ARRAY || itemKind == C.JV_KIND_OBJECT {
+				stack = append(stack, newDecodeFrame(item, itemKind))
+			} else {
+				f.set(scalarToGo(item, itemKind, opts))
+			}
+			continue
+		}
+
+		result := f.result()
+		stack = stack[:len(stack)-1]
+		if len(stack) == 0 {
+			return result
+		}
+		stack[len(stack)-1].set(result)
+	}
+}
+
+// decodeFrame is an array or object part way through conversion by
+// jvToGoKind. It borrows jv.
+type decodeFrame struct {
+	jv     C.jv
+	array  []interface{}          // non-nil for arrays
+	object map[string]interface{} // non-nil for objects
+	i      int                    // the next index, or the object iterator
+	key    string                 // the key of the object's current value
+}
+
+func newDecodeFrame(jv C.jv, kind C.jv_kind) decodeFrame {
+	if kind == C.JV_KIND_ARRAY {
+		return decodeFrame{jv: jv, array: make([]interface{}, int(C.jv_array_length(C.jv_copy(jv))))}
+	}
+	return decodeFrame{jv: jv, object: make(map[string]interface{}), i: int(C.jv_object_iter(jv))}
+}
+
+// next returns the current element, borrowed, or false at the end.
+func (f *decodeFrame) next(opts decodeOptions) (C.jv, bool) {
+	if f.array != nil {
+		if f.i == len(f.array) {
+			return C.jv_invalid(), false
+		}
+		return C.array_get_borrowed(f.jv, C.int(f.i)), true
+	}
+	if C.jv_object_iter_valid(f.jv, C.int(f.i)) == 0 {
+		return C.jv_invalid(), false
+	}
+	k := trackJv(C.jv_object_iter_key(f.jv, C.int(f.i)))
+	f.key = opts.string(jvGoString(k))
+	freeJv(k)
+	// the object keeps the value alive, so it can be borrowed
+	item := trackJv(C.jv_object_iter_value(f.jv, C.int(f.i)))
+	freeJv(item)
+	return item, true
+}
+
+// set stores the converted value of the current element and moves on.
+func (f *decodeFrame) set(v interface{}) {
+	if f.array != nil {
+		f.array[f.i] = v
+		f.i++
+		return
+	}
+	f.object[f.key] = v
+	f.i = int(C.jv_object_iter_next(f.jv, C.int(f.i)))
+}
+
+func (f *decodeFrame) result() interface{} {
+	if f.array != nil {
+		return f.array
+	}
+	return f.object
+}
+
+func scalarToGo(value C.jv, kind C.jv_kind, opts decodeOptions) interface{} {
+	switch kind {
 	case C.JV_KIND_INVALID:
 		return errors.New("invalid")
 	case C.JV_KIND_NULL:
@@ -196,30 +1090,20 @@ func jvToGo(value C.jv) interface{} {
 	case C.JV_KIND_TRUE:
 		return true
 	case C.JV_KIND_NUMBER:
-		number := C.jv_number_value(value)
+		number, ok := jsonFloat(value)
+		if !ok {
+			return nil
+		}
+		if opts.bigNumbers {
+			return bigNumber(value, number)
+		}
 		if C.jv_is_integer(value) == 0 {
 			return float64(number)
 		} else {
 			return int(number)
 		}
 	case C.JV_KIND_STRING:
-		return C.GoString(C.jv_string_value(value))
-	case C.JV_KIND_ARRAY:
-		length := C.jv_array_length(C.jv_copy(value))
-		arr := make([]interface{}, length)
-		for i := range arr {
-			arr[i] = jvToGo(C.jv_array_get(C.jv_copy(value), C.int(i)))
-		}
-		return arr
-	case C.JV_KIND_OBJECT:
-		result := make(map[string]interface{})
-		var k, v C.jv
-		for jv_i := C.jv_object_iter(value); C.jv_object_iter_valid(value, jv_i) != 0; jv_i = C.jv_object_iter_next(value, jv_i) {
-			k = C.jv_object_iter_key(value, jv_i)
-			v = C.jv_object_iter_value(value, jv_i)
-			result[C.GoString(C.jv_string_value(k))] = jvToGo(v)
-		}
-		return result
+		return opts.string(jvGoString(value))
 	default:
 		return errors.New("unknown type")
 	}
@@ -229,6 +1113,56 @@ func freeJv(jv C.jv) {
 	C.jv_free(jv)
 }
 
+// isValid reports whether jv is a value rather than jq's marker for an error
+// or the end of the outputs. null is valid.
 func isValid(jv C.jv) bool {
 	return C.jv_is_valid(jv) != 0
 }
+
+// invalidError returns the message carried by an invalid jv as an error, or
+// nil if it has none (which is how jq signals the end of its outputs).
+func invalidError(jv C.jv) error {
+	msg := trackJv(C.jv_invalid_get_msg(C.jv_copy(jv)))
+	switch C.jv_get_kind(msg) {
+	case C.JV_KIND_NULL:
+		freeJv(msg)
+		return nil
+	case C.JV_KIND_STRING:
+		text := jvGoString(msg)
+		freeJv(msg)
+		return errors.New(text)
+	default:
+		text := dumpJson(msg)
+		freeJv(msg)
+		return errors.New(text)
+	}
+}
+
+// jvFloat converts f to a jv number, or null for NaN, see Handle.
+func jvFloat(f float64) C.jv {
+	switch {
+	case math.IsNaN(f):
+		return C.jv_null()
+	case math.IsInf(f, 1):
+		return C.jv_number(C.double(math.MaxFloat64))
+	case math.IsInf(f, -1):
+		return C.jv_number(C.double(-math.MaxFloat64))
+	}
+	return C.jv_number(C.double(f))
+}
+
+// jsonFloat returns the value of a jv number as jq prints it: infinities
+// become the largest finite doubles, and ok is false for NaN, which prints
+// as null.
+func jsonFloat(jv C.jv) (f float64, ok bool) {
+	f = float64(C.jv_number_value(jv))
+	switch {
+	case math.IsNaN(f):
+		return 0, false
+	case math.IsInf(f, 1):
+		return math.MaxFloat64, true
+	case math.IsInf(f, -1):
+		return -math.MaxFloat64, true
+	}
+	return f, true
+}
@@ -1,12 +1,18 @@
 package jq
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/debug"
+	"strings"
 	"testing"
+	"unsafe"
 )
 
 // assert fails the test if the condition is false.
@@ -42,6 +48,9 @@ func TestJQProgram(t *testing.T) {
 	defer jq.Close()
 
 	equals(t, ".", jq.program)
+	equals(t, ".", jq.Program())
+	equals(t, ".", jq.String())
+	equals(t, "filter .", fmt.Sprintf("filter %v", jq))
 }
 
 func TestTransform(t *testing.T) {
@@ -98,7 +107,6 @@ func TestTransformArrayJsonString(t *testing.T) {
 	ok(t, err)
 	defer jq.Close()
 
-<<<<<<< HEAD
 	jq.HandleJson("[[1], [2], [3]]")
 
 	equals(t, true, jq.Next())
@@ -109,18 +117,6 @@ func TestTransformArrayJsonString(t *testing.T) {
 
 	equals(t, true, jq.Next())
 	equals(t, "[3]", jq.ValueJson())
-=======
-	jq.HandleJson("[1, 2, 3]")
-
-	equals(t, true, jq.Next())
-	equals(t, "1", jq.ValueJson())
-
-	equals(t, true, jq.Next())
-	equals(t, "2", jq.ValueJson())
-
-	equals(t, true, jq.Next())
-	equals(t, "3", jq.ValueJson())
->>>>>>> e351bdc... Fix Segmentation Fault when used ValueJson function.
 
 	equals(t, false, jq.Next())
 }
@@ -128,7 +124,8 @@ func TestTransformArrayJsonString(t *testing.T) {
 // TODO KIND_INVALID
 
 func assertJsonParsed(t *testing.T, expected interface{}, json string) {
-	jv := parseJson(json)
+	jv, err := parseJson(json)
+	ok(t, err)
 	result := jvToGo(jv)
 	freeJv(jv)
 	equals(t, expected, result)
@@ -302,7 +299,8 @@ func TestJVFromGoIntPointer(t *testing.T) {
 
 func TestDumpJSONRefCount(t *testing.T) {
 	text := "{\"foo\":1}"
-	jv := parseJson(text)
+	jv, err := parseJson(text)
+	ok(t, err)
 
 	// check that dumpJson keeps the same refcount
 	// and that repeated use on the same value doesn't crash
@@ -316,3 +314,1043 @@ func TestDumpJSONRefCount(t *testing.T) {
 	freeJv(jv)
 	equals(t, 0, refcount(jv))
 }
+
+func TestValueJsonDebug(t *testing.T) {
+	jq, err := NewJQ(".a")
+	ok(t, err)
+	defer jq.Close()
+
+	equals(t, "<invalid>", jq.ValueJsonDebug())
+	jq.HandleJson(`{"a": [1, {"x": "s"}]}`)
+	equals(t, true, jq.Next())
+	equals(t, `[1,{"x":"s" (1)} (1)] (2)`, jq.ValueJsonDebug())
+
+	// a reference held by Go shows up in the count
+	v := jq.ValueRef()
+	equals(t, `[1,{"x":"s" (1)} (1)] (3)`, jq.ValueJsonDebug())
+	v.Free()
+	equals(t, `[1,{"x":"s" (1)} (1)] (2)`, jq.ValueJsonDebug())
+
+	equals(t, false, jq.Next())
+	equals(t, "<invalid>", jq.ValueJsonDebug())
+}
+
+func TestDecodeArrayKeepsRefCount(t *testing.T) {
+	jv, err := parseJson(`[["a"], "b"]`)
+	ok(t, err)
+	defer freeJv(jv)
+
+	inner := Value{jv: jv}.ArrayGet(0)
+	defer inner.Free()
+	before := refcount(inner.jv)
+	equals(t, []interface{}{[]interface{}{"a"}, "b"}, jvToGo(jv))
+	equals(t, before, refcount(inner.jv))
+}
+
+func TestDecodeObjectKeepsRefCount(t *testing.T) {
+	jv, err := parseJson(`{"a": {"b": "c"}}`)
+	ok(t, err)
+	defer freeJv(jv)
+
+	inner, _ := Value{jv: jv}.ObjectGet("a")
+	defer inner.Free()
+	before := refcount(inner.jv)
+	for i := 0; i < 3; i++ {
+		equals(t, map[string]interface{}{"a": map[string]interface{}{"b": "c"}}, jvToGo(jv))
+	}
+	equals(t, before, refcount(inner.jv))
+}
+
+func TestRuntimeError(t *testing.T) {
+	jq, err := NewJQ(".a")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(1)
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected a runtime error")
+
+	jq.Handle(map[string]interface{}{"a": 1})
+	equals(t, true, jq.Next())
+	equals(t, nil, jq.Err())
+	equals(t, false, jq.Next())
+	equals(t, nil, jq.Err())
+}
+
+func TestSortKeys(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`{"b": 1, "a": {"d": 2, "c": 3}}`)
+	equals(t, true, jq.Next())
+	equals(t, `{"b":1,"a":{"d":2,"c":3}}`, jq.ValueJson())
+
+	jq.SetSortKeys(true)
+	jq.HandleJson(`{"b": 1, "a": {"d": 2, "c": 3}}`)
+	equals(t, true, jq.Next())
+	equals(t, `{"a":{"c":3,"d":2},"b":1}`, jq.ValueJson())
+}
+
+func TestCompileErrorMessage(t *testing.T) {
+	_, err := NewJQ(".a[")
+	assert(t, err != nil, "expected a compile error")
+	assert(t, strings.Contains(err.Error(), "syntax error"), "missing jq error text: %s", err)
+}
+
+func TestMustNewJQ(t *testing.T) {
+	jq := MustNewJQ(".")
+	jq.Close()
+}
+
+func TestMustNewJQPanics(t *testing.T) {
+	defer func() {
+		r := recover()
+		assert(t, r != nil, "expected MustNewJQ to panic")
+		assert(t, strings.Contains(r.(string), "syntax error"), "missing jq error text: %v", r)
+	}()
+	MustNewJQ(".a[")
+}
+
+func TestNewJQFromReader(t *testing.T) {
+	jq, err := NewJQFromReader(strings.NewReader(".a"))
+	ok(t, err)
+	jq.Handle(map[string]int{"a": 1})
+	equals(t, true, jq.Next())
+	equals(t, 1, jq.Value())
+	jq.Close()
+
+	dir := t.TempDir()
+	ok(t, os.WriteFile(filepath.Join(dir, "util.jq"), []byte(`def double: . * 2;`), 0o644))
+	ok(t, os.WriteFile(filepath.Join(dir, "main.jq"), []byte(`import "util" as u {search: "./"}; [u::double, get_prog_origin]`), 0o644))
+	f, err := os.Open(filepath.Join(dir, "main.jq"))
+	ok(t, err)
+	defer f.Close()
+	jq, err = NewJQFromReader(f)
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle(21)
+	equals(t, true, jq.Next())
+	equals(t, []interface{}{42, dir}, jq.Value())
+}
+
+func TestAppendValueJson(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`{"a": [1, "x"]}`)
+	equals(t, true, jq.Next())
+
+	buf := []byte("prefix ")
+	buf = jq.AppendValueJson(buf)
+	equals(t, `prefix {"a":[1,"x"]}`, string(buf))
+
+	if trackingLeaks {
+		t.Skip("leak tracking allocates")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = jq.AppendValueJson(buf[:0])
+	})
+	equals(t, 0.0, allocs)
+	equals(t, `{"a":[1,"x"]}`, string(buf))
+}
+
+// Format strings are implemented by jq itself; these check that their
+// output, including binary data from @base64d, survives the trip back to Go.
+
+func assertFormat(t *testing.T, program string, input interface{}, expected string) {
+	jq, err := NewJQ(program)
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(input)
+	equals(t, true, jq.Next())
+	equals(t, expected, jq.ValueString())
+	equals(t, expected, jq.Value())
+	equals(t, false, jq.Next())
+	ok(t, jq.Err())
+}
+
+func TestFormatText(t *testing.T) {
+	assertFormat(t, "@text", []interface{}{1, "a"}, `[1,"a"]`)
+}
+
+func TestFormatJson(t *testing.T) {
+	assertFormat(t, "@json", map[string]interface{}{"a": "x\"y"}, `{"a":"x\"y"}`)
+}
+
+func TestFormatBase64(t *testing.T) {
+	assertFormat(t, "@base64", "hello", "aGVsbG8=")
+}
+
+func TestFormatBase64NUL(t *testing.T) {
+	assertFormat(t, "@base64", "a\x00b", "YQBi")
+}
+
+func TestFormatBase64Decode(t *testing.T) {
+	assertFormat(t, "@base64d", "aGVsbG8=", "hello")
+}
+
+func TestFormatBase64DecodeNUL(t *testing.T) {
+	assertFormat(t, "@base64d", "AGIA", "\x00b\x00")
+}
+
+func TestFormatBase64RoundTrip(t *testing.T) {
+	assertFormat(t, "@base64 | @base64d", "x\x00y\x00z", "x\x00y\x00z")
+}
+
+// tricky exercises escaping in the text formats: spaces, reserved URI
+// characters, quotes, markup, a newline, NUL and multi-byte UTF-8. The
+// expected outputs are those of the jq command line tool; note that jq
+// writes NUL as the two characters \0 in @html, @sh and @csv.
+const tricky = "a b&c=d/\u00e9?\"<x>'\n\x00\u00fc"
+
+func TestFormatURI(t *testing.T) {
+	assertFormat(t, "@uri", tricky, "a%20b%26c%3Dd%2F%C3%A9%3F%22%3Cx%3E'%0A%00%C3%BC")
+}
+
+func TestFormatHTML(t *testing.T) {
+	assertFormat(t, "@html", tricky, "a b&amp;c=d/\u00e9?&quot;&lt;x&gt;&apos;\n\\0\u00fc")
+}
+
+func TestFormatSh(t *testing.T) {
+	assertFormat(t, "@sh", tricky, "'a b&c=d/\u00e9?\"<x>'\\''\n\\0\u00fc'")
+	assertFormat(t, "@sh", []interface{}{"it's", 1, nil, false}, `'it'\''s' 1 null false`)
+}
+
+func TestFormatCSV(t *testing.T) {
+	row := []interface{}{1, "a,b", `say "hi"`, "line\nbreak", nil, true, "\u00e9\x00"}
+	assertFormat(t, "@csv", row, "1,\"a,b\",\"say \"\"hi\"\"\",\"line\nbreak\",,true,\"\u00e9\\0\"")
+}
+
+func TestFormatTSV(t *testing.T) {
+	row := []interface{}{1, "a\tb", `c\d`, "line\nbreak\r", nil, true, "\u00e9"}
+	assertFormat(t, "@tsv", row, `1	a\tb	c\\d	line\nbreak\r		true	`+"\u00e9")
+}
+
+func TestStringNULJson(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle("a\x00b")
+	equals(t, true, jq.Next())
+	equals(t, `"a\u0000b"`, jq.ValueJson())
+}
+
+func TestObjectKeyNUL(t *testing.T) {
+	assertGoJvConversion(t, map[string]interface{}{"a\x00b": 1}, map[string]interface{}{"a\x00b": 1})
+}
+
+func TestNextBeforeHandle(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	equals(t, false, jq.Next())
+	ok(t, jq.Err())
+}
+
+func TestNextAfterEnd(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(1)
+	equals(t, true, jq.Next())
+	equals(t, false, jq.Next())
+	equals(t, false, jq.Next())
+}
+
+func TestAll(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]int{1, 2, 3})
+	results, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{1, 2, 3}, results)
+}
+
+// counter returns a source of the numbers from 0 to n-1.
+func counter(n int) func() (interface{}, bool) {
+	i := 0
+	return func() (interface{}, bool) {
+		if i == n {
+			return nil, false
+		}
+		i++
+		return i - 1, true
+	}
+}
+
+func TestHandleFrom(t *testing.T) {
+	jq, err := NewJQ("range(.)")
+	ok(t, err)
+	defer jq.Close()
+
+	// inputs with no outputs are passed over
+	jq.HandleFrom(counter(4))
+	results, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{0, 0, 1, 0, 1, 2}, results)
+
+	jq.HandleFrom(counter(0))
+	equals(t, false, jq.Next())
+	ok(t, jq.Err())
+
+	// the source is only read as far as needed
+	pulled := 0
+	next := counter(1000)
+	jq.HandleFrom(func() (interface{}, bool) {
+		pulled++
+		return next()
+	})
+	results, err = jq.AllN(2)
+	ok(t, err)
+	equals(t, 2, len(results))
+	equals(t, 3, pulled)
+	equals(t, false, jq.Next())
+
+	// Handle replaces the source
+	jq.HandleFrom(counter(1000))
+	jq.Handle(1)
+	results, err = jq.All()
+	ok(t, err)
+	equals(t, []interface{}{0}, results)
+}
+
+func TestHandleFromError(t *testing.T) {
+	jq, err := NewJQ("if . == 2 then error(\"two\") else . end")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleFrom(counter(5))
+	results, err := jq.All()
+	equals(t, []interface{}{0, 1}, results)
+	equals(t, "two", fmt.Sprint(err))
+	equals(t, false, jq.Next())
+
+	jq.HandleFrom(func() (interface{}, bool) { return make(chan int), true })
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected an encoding error")
+}
+
+func TestAtLeastOne(t *testing.T) {
+	jq, err := NewJQ(".[] | select(.id == 2)")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]map[string]int{{"id": 1}, {"id": 2}})
+	results, err := jq.AtLeastOne()
+	ok(t, err)
+	equals(t, []interface{}{map[string]interface{}{"id": 2}}, results)
+
+	jq.Handle([]map[string]int{{"id": 1}})
+	results, err = jq.AtLeastOne()
+	equals(t, ErrNoOutputs, err)
+	equals(t, 0, len(results))
+
+	// the program's own errors take precedence
+	jq.Handle(1)
+	_, err = jq.AtLeastOne()
+	assert(t, err != nil && err != ErrNoOutputs, "expected a runtime error, got %v", err)
+}
+
+func TestAllError(t *testing.T) {
+	jq, err := NewJQ(".[] | .a")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`[{"a": 1}, {"a": 2}, 3, {"a": 4}]`)
+	results, err := jq.All()
+	assert(t, err != nil, "expected a runtime error")
+	// outputs before the error are kept
+	equals(t, []interface{}{1, 2}, results)
+
+	jq.HandleJson(`[{"a": 1}, {"a": 2}, 3, {"a": 4}]`)
+	results, err = jq.AllN(5)
+	assert(t, err != nil, "expected a runtime error")
+	equals(t, []interface{}{1, 2}, results)
+}
+
+func TestNullIsNotTheEnd(t *testing.T) {
+	jq, err := NewJQ(`null, .missing, empty, [][0], .present`)
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`{"present": null}`)
+	for i := 0; i < 4; i++ {
+		equals(t, true, jq.Next())
+		equals(t, nil, jq.Value())
+		equals(t, "null", jq.ValueKind())
+	}
+	equals(t, false, jq.Next())
+	ok(t, jq.Err())
+
+	null, err := parseJson(`null`)
+	ok(t, err)
+	equals(t, true, isValid(null))
+}
+
+func TestAllN(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]int{1, 2, 3})
+	results, err := jq.AllN(2)
+	ok(t, err)
+	equals(t, []interface{}{1, 2}, results)
+	equals(t, false, jq.Next())
+
+	jq.Handle([]int{4})
+	results, err = jq.AllN(2)
+	ok(t, err)
+	equals(t, []interface{}{4}, results)
+}
+
+func TestAllNUnbounded(t *testing.T) {
+	jq, err := NewJQ("repeat(.)")
+	ok(t, err)
+	defer jq.Close()
+
+	for i := 0; i < 3; i++ {
+		jq.HandleJson(`{"a": [1, 2]}`)
+		results, err := jq.AllN(3)
+		ok(t, err)
+		equals(t, 3, len(results))
+	}
+}
+
+func TestReset(t *testing.T) {
+	jq, err := NewJQ(".[] | .a")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`[{"a": 1}, {"a": 2}]`)
+	equals(t, true, jq.Next())
+	jq.Reset()
+	equals(t, false, jq.Next())
+	ok(t, jq.Err())
+
+	jq.HandleJson(`[1]`)
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected a runtime error")
+	jq.Reset()
+	ok(t, jq.Err())
+
+	jq.HandleJson(`[{"a": 3}]`)
+	results, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{3}, results)
+}
+
+func TestHandleJsonBytes(t *testing.T) {
+	jq, err := NewJQ(".a")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJsonBytes([]byte(`{"a": "x\u0000y"}`)))
+	equals(t, true, jq.Next())
+	equals(t, "x\x00y", jq.Value())
+
+	assert(t, jq.HandleJsonBytes([]byte(`{"a": 1}`+"\x00")) != nil, "expected trailing NUL to be rejected")
+	assert(t, jq.HandleJsonBytes([]byte{}) != nil, "expected empty input to be rejected")
+	assert(t, jq.HandleJsonBytes(nil) != nil, "expected nil input to be rejected")
+}
+
+func TestHandleJsonNUL(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	assert(t, jq.HandleJson("[1]\x00") != nil, "expected embedded NUL to be rejected")
+	assert(t, jq.HandleJson("") != nil, "expected empty input to be rejected")
+}
+
+func TestHandleJsonBytesDuplicateKeys(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetRejectDuplicateKeys(true)
+	equals(t, &DuplicateKeyError{Key: "a"}, jq.HandleJsonBytes([]byte(`{"a": 1, "a": 2}`)))
+}
+
+func TestHandleUnknownType(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]interface{}{1, make(chan int)})
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil && strings.HasPrefix(jq.Err().Error(), "unknown type"), "unexpected error: %v", jq.Err())
+
+	jq.Handle(1)
+	equals(t, true, jq.Next())
+	ok(t, jq.Err())
+}
+
+func TestHandleAddresses(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	x := 1
+	for _, tc := range []struct {
+		value interface{}
+		err   string
+	}{
+		{uintptr(1), "uintptr cannot be encoded"},
+		{map[string]interface{}{"p": unsafe.Pointer(&x)}, "unsafe.Pointer cannot be encoded"},
+	} {
+		jq.Handle(tc.value)
+		equals(t, false, jq.Next())
+		equals(t, tc.err, fmt.Sprint(jq.Err()))
+	}
+}
+
+type pointKey struct{ x, y int }
+
+func (p pointKey) MarshalText() ([]byte, error) {
+	if p.x < 0 {
+		return nil, errors.New("negative")
+	}
+	return []byte(fmt.Sprintf("%d,%d", p.x, p.y)), nil
+}
+
+func TestHandleMapKeys(t *testing.T) {
+	for _, value := range []interface{}{
+		map[int]string{1: "a", -2: "b"},
+		map[uint8]bool{255: true},
+		map[pointKey]int{{1, 2}: 3},
+	} {
+		want, err := json.Marshal(value)
+		ok(t, err)
+		got, err := Marshal(value)
+		ok(t, err)
+		equals(t, string(want), string(got))
+	}
+
+	// encoding/json rejects interface keys, but YAML decoders produce them
+	got, err := Marshal(map[interface{}]int{"a": 1, 2: 2})
+	ok(t, err)
+	equals(t, `{"2":2,"a":1}`, string(got))
+
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+	for _, tc := range []struct {
+		value interface{}
+		err   string
+	}{
+		{map[float64]int{1.5: 1}, "float64 cannot be used as an object key"},
+		{map[interface{}]int{1.5: 1}, "float64 cannot be used as an object key"},
+		{map[interface{}]int{nil: 1}, "nil cannot be used as an object key"},
+		{map[pointKey]int{{-1, 0}: 1}, "jq.pointKey key: negative"},
+	} {
+		jq.Handle(tc.value)
+		equals(t, false, jq.Next())
+		equals(t, tc.err, fmt.Sprint(jq.Err()))
+	}
+}
+
+func TestRerun(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	assert(t, jq.Rerun() != nil, "expected an error before any input")
+
+	jq.Handle([]int{1, 2, 3})
+	equals(t, true, jq.Next())
+	equals(t, 1, jq.Value())
+
+	// rerunning part way through starts again from the beginning
+	ok(t, jq.Rerun())
+	all, err := jq.All()
+	ok(t, err)
+	equals(t, []interface{}{1, 2, 3}, all)
+
+	ok(t, jq.Rerun())
+	all, err = jq.All()
+	ok(t, err)
+	equals(t, []interface{}{1, 2, 3}, all)
+
+	ok(t, jq.HandleJson(`[4]`))
+	ok(t, jq.Rerun())
+	all, err = jq.All()
+	ok(t, err)
+	equals(t, []interface{}{4}, all)
+
+	jq.Handle(make(chan int))
+	assert(t, jq.Rerun() != nil, "expected an error after a failed Handle")
+}
+
+func TestHandleNilPointer(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	var p *int
+	jq.Handle(p)
+	equals(t, true, jq.Next())
+	equals(t, nil, jq.Value())
+}
+
+func nested(depth int) interface{} {
+	var v interface{} = 1
+	for i := 0; i < depth; i++ {
+		v = []interface{}{v}
+	}
+	return v
+}
+
+func TestHandleMaxDepth(t *testing.T) {
+	jq, err := NewJQ("[paths] | length")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetMaxDepth(10)
+	jq.Handle(nested(9))
+	equals(t, true, jq.Next())
+	equals(t, 9, jq.Value())
+
+	jq.Handle(nested(10))
+	equals(t, false, jq.Next())
+	equals(t, "exceeded maximum depth of 10 encoding int", jq.Err().Error())
+}
+
+func TestHandleDefaultMaxDepth(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nested(defaultMaxDepth))
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected the default depth limit to apply")
+}
+
+func TestHandleCycle(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	m := map[string]interface{}{"a": 1}
+	m["self"] = m
+	jq.Handle(m)
+	equals(t, false, jq.Next())
+	equals(t, "encountered a cycle via map[string]interface {}", jq.Err().Error())
+
+	s := []interface{}{1, nil}
+	s[1] = s
+	jq.Handle(s)
+	equals(t, false, jq.Next())
+	equals(t, "encountered a cycle via []interface {}", jq.Err().Error())
+}
+
+func TestHandleJsonTrailingData(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	for text, msg := range map[string]string{
+		`{"a": 1} oops`:    "Invalid JSON: Invalid numeric literal at EOF at line 1, column 13",
+		`1 2`:              "Invalid JSON: Unexpected extra JSON values",
+		`{"a": 1} {"b":2}`: "Invalid JSON: Unexpected extra JSON values",
+		`[1]]`:             "Invalid JSON: Unmatched ']' at line 1, column 4",
+	} {
+		err := jq.HandleJson(text)
+		assert(t, err != nil, "expected %q to be rejected", text)
+		equals(t, msg, err.Error())
+		assert(t, jq.HandleJsonBytes([]byte(text)) != nil, "expected %q to be rejected", text)
+	}
+
+	ok(t, jq.HandleJson("{\"a\": 1} \n\t"))
+	equals(t, true, jq.Next())
+	equals(t, map[string]interface{}{"a": 1}, jq.Value())
+}
+
+func TestNumberLiteralPassthrough(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJson(`[3.140, 1E2, 100000000000000000001]`))
+	equals(t, true, jq.Next())
+	// jq 1.7 keeps the text of number literals
+	if linkedMinorVersion() < 7 {
+		equals(t, `[3.14,100,1e+20]`, jq.ValueJson())
+		t.Skip("linked libjq does not preserve number literals")
+	}
+	equals(t, `[3.140,1E2,100000000000000000001]`, jq.ValueJson())
+}
+
+func TestSetStderrHandler(t *testing.T) {
+	jq, err := NewJQ(`stderr | "x" | stderr`)
+	ok(t, err)
+	defer jq.Close()
+
+	var written []string
+	err = jq.SetStderrHandler(func(raw string) { written = append(written, raw) })
+	if linkedMinorVersion() < 7 {
+		assert(t, errors.Is(err, ErrUnsupported), "expected ErrUnsupported, got %v", err)
+		t.Skip("linked libjq has no stderr callback")
+	}
+	ok(t, err)
+
+	ok(t, jq.HandleJson(`{"a":[1,2]}`))
+	equals(t, true, jq.Next())
+	equals(t, `"x"`, jq.ValueJson())
+	equals(t, []string{`{"a":[1,2]}`, "x"}, written)
+}
+
+func TestEmptyProgram(t *testing.T) {
+	for _, program := range []string{"", " \n\t"} {
+		jq, err := NewJQ(program)
+		ok(t, err)
+		equals(t, program, jq.Program())
+
+		jq.Handle(map[string]int{"a": 1})
+		all, err := jq.All()
+		ok(t, err)
+		equals(t, []interface{}{map[string]interface{}{"a": 1}}, all)
+		jq.Close()
+	}
+}
+
+func TestCancel(t *testing.T) {
+	jq, err := NewJQ("range(1e15)")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	jq.Cancel()
+	equals(t, false, jq.Next())
+	equals(t, ErrCancelled, jq.Err())
+	equals(t, false, jq.Next())
+
+	// a new input starts afresh
+	jq.Cancel()
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	equals(t, 0, jq.Value())
+}
+
+func TestCancelFromAnotherGoroutine(t *testing.T) {
+	jq, err := NewJQ("repeat(1)")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	go jq.Cancel()
+	for jq.Next() {
+	}
+	equals(t, ErrCancelled, jq.Err())
+}
+
+func TestErrorEndsOutputs(t *testing.T) {
+	input := []interface{}{map[string]int{"a": 1}, "oops", map[string]int{"a": 3}}
+
+	jq, err := NewJQ(".[] | .a")
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle(input)
+	equals(t, true, jq.Next())
+	equals(t, 1, jq.Value())
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected a runtime error")
+	equals(t, false, jq.Next())
+
+	// catching the error in the program keeps the remaining outputs
+	for _, program := range []string{".[] | .a?", ".[] | try .a catch empty"} {
+		results, err := RunWith(program, input, nil)
+		ok(t, err)
+		equals(t, []interface{}{1, 3}, results)
+	}
+}
+
+func TestSingle(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]int{7})
+	value, err := jq.Single()
+	ok(t, err)
+	equals(t, 7, value)
+
+	jq.Handle([]int{})
+	_, err = jq.Single()
+	equals(t, "Expected one output, got none", fmt.Sprint(err))
+
+	jq.Handle([]int{1, 2, 3})
+	_, err = jq.Single()
+	equals(t, "Expected one output, got more than one", fmt.Sprint(err))
+	equals(t, false, jq.Next())
+
+	jq.Handle(1)
+	_, err = jq.Single()
+	assert(t, err != nil && !strings.HasPrefix(err.Error(), "Expected"), "expected a runtime error, got %v", err)
+
+	// an error after the only output still counts
+	jq2, err := NewJQ(".[] | 1 / .")
+	ok(t, err)
+	defer jq2.Close()
+	jq2.Handle([]interface{}{1, "x"})
+	_, err = jq2.Single()
+	assert(t, err != nil && !strings.HasPrefix(err.Error(), "Expected"), "expected a runtime error, got %v", err)
+}
+
+func TestMatches(t *testing.T) {
+	jq, err := NewJQ(".age > 18")
+	ok(t, err)
+	defer jq.Close()
+
+	matched, err := jq.Matches(map[string]int{"age": 30})
+	ok(t, err)
+	equals(t, true, matched)
+
+	matched, err = jq.Matches(map[string]int{"age": 12})
+	ok(t, err)
+	equals(t, false, matched)
+
+	// any truthy output is enough, and later ones are dropped
+	jq2, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq2.Close()
+	for _, tc := range []struct {
+		in      interface{}
+		matched bool
+	}{
+		{[]interface{}{}, false},
+		{[]interface{}{nil, false}, false},
+		{[]interface{}{nil, 0, false}, true},
+		{[]interface{}{"", nil}, true},
+	} {
+		matched, err := jq2.Matches(tc.in)
+		ok(t, err)
+		equals(t, tc.matched, matched)
+		equals(t, false, jq2.Next())
+	}
+
+	_, err = jq2.Matches(1)
+	assert(t, err != nil, "expected a runtime error")
+}
+
+func TestAllMatchAnyMatch(t *testing.T) {
+	jq, err := NewJQ(".age > 18")
+	ok(t, err)
+	defer jq.Close()
+
+	adult, child := map[string]int{"age": 30}, map[string]int{"age": 12}
+	for _, tc := range []struct {
+		inputs   []interface{}
+		all, any bool
+	}{
+		{nil, true, false},
+		{[]interface{}{adult, adult}, true, true},
+		{[]interface{}{adult, child}, false, true},
+		{[]interface{}{child, child}, false, false},
+	} {
+		all, err := jq.AllMatch(tc.inputs)
+		ok(t, err)
+		equals(t, tc.all, all)
+		any, err := jq.AnyMatch(tc.inputs)
+		ok(t, err)
+		equals(t, tc.any, any)
+	}
+
+	// both stop before the input that would fail
+	all, err := jq.AllMatch([]interface{}{child, "x"})
+	ok(t, err)
+	equals(t, false, all)
+	any, err := jq.AnyMatch([]interface{}{adult, "x"})
+	ok(t, err)
+	equals(t, true, any)
+
+	_, err = jq.AllMatch([]interface{}{adult, "x"})
+	assert(t, err != nil, "expected a runtime error")
+	_, err = jq.AnyMatch([]interface{}{child, "x"})
+	assert(t, err != nil, "expected a runtime error")
+}
+
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *orderedMap) Keys() []string { return m.keys }
+
+func (m *orderedMap) Get(key string) (interface{}, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func TestHandleOrderedMap(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	inner := &orderedMap{[]string{"y", "x"}, map[string]interface{}{"x": 1, "y": 2}}
+	outer := &orderedMap{[]string{"z", "a", "m"}, map[string]interface{}{"z": inner, "a": []interface{}{inner}, "m": nil}}
+	jq.Handle(outer)
+	equals(t, true, jq.Next())
+	equals(t, `{"z":{"y":2,"x":1},"a":[{"y":2,"x":1}],"m":null}`, jq.ValueJson())
+
+	var missing *orderedMap
+	jq.Handle(missing)
+	equals(t, true, jq.Next())
+	equals(t, nil, jq.Value())
+
+	jq.Handle(&orderedMap{[]string{"c"}, map[string]interface{}{"c": make(chan int)}})
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected an encoding error")
+}
+
+func TestHandlePairs(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	inner := Pairs{{"y", 2}, {"x", 1}}
+	jq.Handle(Pairs{{"z", inner}, {"a", []interface{}{&inner}}, {"m", nil}, {"z", 3}})
+	equals(t, true, jq.Next())
+	equals(t, `{"z":3,"a":[{"y":2,"x":1}],"m":null}`, jq.ValueJson())
+
+	jq.Handle(Pairs{})
+	equals(t, true, jq.Next())
+	equals(t, `{}`, jq.ValueJson())
+
+	jq.Handle(Pairs{{"c", make(chan int)}})
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected an encoding error")
+}
+
+func TestHandleNaNAndInf(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	for _, tc := range []struct {
+		in    interface{}
+		value interface{}
+		json  string
+	}{
+		{math.NaN(), nil, "null"},
+		{math.Inf(1), math.MaxFloat64, "1.7976931348623157e+308"},
+		{math.Inf(-1), -math.MaxFloat64, "-1.7976931348623157e+308"},
+		{float32(math.Inf(1)), math.MaxFloat64, "1.7976931348623157e+308"},
+		{[]float64{1, math.NaN()}, []interface{}{1, nil}, "[1,null]"},
+	} {
+		jq.Handle(tc.in)
+		equals(t, true, jq.Next())
+		equals(t, tc.value, jq.Value())
+		equals(t, tc.json, jq.ValueJson())
+	}
+}
+
+func TestJqNaNAndInf(t *testing.T) {
+	jq, err := NewJQ("[nan, infinite, -infinite]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	equals(t, "[null,1.7976931348623157e+308,-1.7976931348623157e+308]", jq.ValueJson())
+	equals(t, []interface{}{nil, math.MaxFloat64, -math.MaxFloat64}, jq.Value())
+
+	var floats []*float64
+	ok(t, jq.ValueInto(&floats))
+	equals(t, 3, len(floats))
+	equals(t, (*float64)(nil), floats[0])
+	equals(t, math.MaxFloat64, *floats[1])
+	equals(t, -math.MaxFloat64, *floats[2])
+}
+
+func TestValueTyped(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`[null, true, false, 1.5, "s", [1], {"a": 1}]`)
+	expected := []struct {
+		value interface{}
+		kind  string
+	}{
+		{nil, "null"},
+		{true, "boolean"},
+		{false, "boolean"},
+		{1.5, "number"},
+		{"s", "string"},
+		{[]interface{}{1}, "array"},
+		{map[string]interface{}{"a": 1}, "object"},
+	}
+	for _, e := range expected {
+		equals(t, true, jq.Next())
+		value, kind := jq.ValueTyped()
+		equals(t, e.value, value)
+		equals(t, e.kind, kind)
+		equals(t, e.kind, jq.ValueKind())
+	}
+	equals(t, false, jq.Next())
+}
+
+func TestValueKindMatchesJqType(t *testing.T) {
+	kinds, err := NewJQ(".[]")
+	ok(t, err)
+	defer kinds.Close()
+	types, err := NewJQ(".[] | type")
+	ok(t, err)
+	defer types.Close()
+
+	input := `[null, true, false, 1, "s", [], {}]`
+	kinds.HandleJson(input)
+	types.HandleJson(input)
+	for types.Next() {
+		equals(t, true, kinds.Next())
+		equals(t, types.Value(), kinds.ValueKind())
+	}
+}
+
+func TestDecodeDeeplyNested(t *testing.T) {
+	// deeper than jq's parser accepts, but programs can build it
+	jq, err := NewJQ(`reduce range(.) as $i ("leaf"; if $i % 2 == 0 then [.] else {k: .} end)`)
+	ok(t, err)
+	defer jq.Close()
+
+	// decoding must not need a stack proportional to the depth
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	const depth = 100000
+	jq.Handle(depth)
+	equals(t, true, jq.Next())
+	v := jq.Value()
+	for i := depth - 1; i >= 0; i-- {
+		if i%2 == 0 {
+			v = v.([]interface{})[0]
+		} else {
+			v = v.(map[string]interface{})["k"]
+		}
+	}
+	equals(t, "leaf", v)
+}
+
+func BenchmarkDecodeArray(b *testing.B) {
+	items := make([]interface{}, 100000)
+	for i := range items {
+		items[i] = i
+	}
+	jv := goToJv(items)
+	defer freeJv(jv)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		jvToGo(jv)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !jqdebug
+
+package jq
+
+// #include <jv.h>
+import "C"
+
+// Without the jqdebug build tag neither Values nor jq's own values are
+// tracked and these cost nothing; see leaktrack_jqdebug.go.
+
+func trackValue(v Value) Value { return v }
+
+func untrackValue(v Value) {}
+
+const trackingLeaks = false
+
+func trackJv(jv C.jv) C.jv { return jv }
+
+func trackerRefs(jv C.jv) int { return 0 }
+
+func openInstance() {}
+
+func closeInstance() {}
+
+// LeakedValues lists the Values that have not been freed, when built with
+// the jqdebug tag. Without it there is no tracking and it returns nil.
+func LeakedValues() []string { return nil }
+
+// FreeLeakedValues frees the Values LeakedValues lists, when built with the
+// jqdebug tag. Without it it does nothing and returns 0.
+func FreeLeakedValues() int { return 0 }
+
+// LeakedAllocations lists the jq values the package allocated that were
+// still referenced when the last JQ was closed, when built with the jqdebug
+// tag. Without it there is no tracking and it returns nil.
+func LeakedAllocations() []string { return nil }
@@ -0,0 +1,218 @@
+//go:build jqdebug
+
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// leaks records, for each allocation referenced by a live Value, where each
+// of those Values was created. Values of kinds that jq does not allocate,
+// such as numbers, cannot leak and are not recorded.
+var leaks = struct {
+	sync.Mutex
+	live map[unsafe.Pointer]*leak
+}{live: make(map[unsafe.Pointer]*leak)}
+
+type leak struct {
+	jv     C.jv
+	stacks []string
+}
+
+// jvAllocation returns the allocation behind jv, or nil if it has none.
+func jvAllocation(jv C.jv) unsafe.Pointer {
+	switch C.jv_get_kind(jv) {
+	case C.JV_KIND_STRING, C.JV_KIND_ARRAY, C.JV_KIND_OBJECT, C.JV_KIND_INVALID:
+		return *(*unsafe.Pointer)(unsafe.Pointer(&jv.u))
+	}
+	return nil
+}
+
+func trackValue(v Value) Value {
+	if p := jvAllocation(v.jv); p != nil {
+		leaks.Lock()
+		l := leaks.live[p]
+		if l == nil {
+			l = &leak{jv: v.jv}
+			leaks.live[p] = l
+		}
+		l.stacks = append(l.stacks, string(debug.Stack()))
+		leaks.Unlock()
+	}
+	return v
+}
+
+func untrackValue(v Value) {
+	p := jvAllocation(v.jv)
+	if p == nil {
+		return
+	}
+	leaks.Lock()
+	defer leaks.Unlock()
+	if l := leaks.live[p]; l != nil && len(l.stacks) > 1 {
+		l.stacks = l.stacks[:len(l.stacks)-1]
+	} else {
+		delete(leaks.live, p)
+	}
+}
+
+// LeakedValues lists the Values that have been created but not freed, or
+// handed to a function that takes ownership of them, each as the stack
+// trace of where it was created. It is only available when built with the
+// jqdebug tag, for tests to check after closing everything, e.g.
+//
+//	go test -tags jqdebug ./...
+func LeakedValues() []string {
+	leaks.Lock()
+	defer leaks.Unlock()
+	var stacks []string
+	for _, l := range leaks.live {
+		stacks = append(stacks, l.stacks...)
+	}
+	return stacks
+}
+
+// FreeLeakedValues frees every Value LeakedValues lists and returns how
+// many there were, so one leaky test does not fail the ones after it. The
+// Values must no longer be reachable: freeing one again afterwards would
+// free jq's memory twice.
+func FreeLeakedValues() int {
+	leaks.Lock()
+	defer leaks.Unlock()
+	n := 0
+	for p, l := range leaks.live {
+		for range l.stacks {
+			freeJv(l.jv)
+			n++
+		}
+		delete(leaks.live, p)
+	}
+	return n
+}
+
+// allocations holds a reference to each value the package's helpers
+// allocate or take from jq, such as the strings it builds and the keys and
+// items it iterates over, so that the memory stays valid to inspect. When
+// the last open JQ is closed every value that nothing but this reference
+// holds is released, and any other is a leak.
+var allocations = struct {
+	sync.Mutex
+	live map[unsafe.Pointer]*allocation
+	open int // JQs not yet closed
+}{live: make(map[unsafe.Pointer]*allocation)}
+
+type allocation struct {
+	jv     C.jv
+	pcs    []uintptr // where it was first seen
+	leaked bool
+}
+
+const trackingLeaks = true
+
+// trackerRefs returns how many references to jv allocations holds.
+func trackerRefs(jv C.jv) int {
+	p := jvAllocation(jv)
+	if p == nil {
+		return 0
+	}
+	allocations.Lock()
+	defer allocations.Unlock()
+	if allocations.live[p] == nil {
+		return 0
+	}
+	return 1
+}
+
+func trackJv(jv C.jv) C.jv {
+	p := jvAllocation(jv)
+	if p == nil {
+		return jv
+	}
+	allocations.Lock()
+	defer allocations.Unlock()
+	if allocations.live[p] == nil {
+		pcs := make([]uintptr, 32)
+		n := runtime.Callers(2, pcs)
+		allocations.live[p] = &allocation{jv: C.jv_copy(jv), pcs: pcs[:n]}
+	}
+	return jv
+}
+
+func openInstance() {
+	allocations.Lock()
+	allocations.open++
+	allocations.Unlock()
+}
+
+func closeInstance() {
+	allocations.Lock()
+	defer allocations.Unlock()
+	if allocations.open--; allocations.open > 0 {
+		return
+	}
+
+	// releasing a container can leave its items held only here, so repeat
+	// until nothing more is released
+	for released := true; released; {
+		released = false
+		for p, a := range allocations.live {
+			// jq keeps the reference count first in every allocation
+			if *(*C.int)(p) == 1 {
+				freeJv(a.jv)
+				delete(allocations.live, p)
+				released = true
+			}
+		}
+	}
+
+	leaked := 0
+	for _, a := range allocations.live {
+		if !a.leaked {
+			a.leaked = true
+			leaked++
+		}
+	}
+	if leaked > 0 {
+		fmt.Fprintf(os.Stderr, "jq: %d values still referenced after the last JQ was closed, see LeakedAllocations\n", leaked)
+	}
+}
+
+// LeakedAllocations lists the jq values the package allocated or took from
+// jq that were still referenced when the last open JQ was closed, each as
+// the stack trace of where the package first saw it. Close reports on
+// stderr when it finds new ones. It is only available when built with the
+// jqdebug tag, e.g.
+//
+//	go test -tags jqdebug ./...
+//
+// A value freed after it was reported is released, and drops off the list,
+// the next time the last JQ is closed.
+func LeakedAllocations() []string {
+	allocations.Lock()
+	defer allocations.Unlock()
+	var stacks []string
+	for _, a := range allocations.live {
+		if !a.leaked {
+			continue
+		}
+		var stack strings.Builder
+		frames := runtime.CallersFrames(a.pcs)
+		for {
+			frame, more := frames.Next()
+			fmt.Fprintf(&stack, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+			if !more {
+				break
+			}
+		}
+		stacks = append(stacks, stack.String())
+	}
+	return stacks
+}
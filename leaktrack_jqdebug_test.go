@@ -0,0 +1,65 @@
+//go:build jqdebug
+
+package jq
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLeakedValues(t *testing.T) {
+	FreeLeakedValues()
+
+	jq, err := NewJQ(".")
+	ok(t, err)
+	jq.HandleJson(`{"a": [1, "x"]}`)
+	equals(t, true, jq.Next())
+	root := jq.ValueRef()
+	a, _ := root.ObjectGet("a")
+	x := a.ArrayGet(1)
+	// numbers are not allocated, so cannot leak
+	a.ArrayGet(0)
+	ObjectValue().With("k", StringValue("v"))
+	jq.Close()
+
+	equals(t, 4, len(LeakedValues()))
+	root.Free()
+	a.Free()
+	x.Free()
+	equals(t, 1, len(LeakedValues()))
+
+	equals(t, 1, FreeLeakedValues())
+	equals(t, 0, len(LeakedValues()))
+}
+
+func TestLeakedAllocations(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	jq.Close()
+	before := len(LeakedAllocations())
+
+	jq, err = NewJQ(".")
+	ok(t, err)
+	ok(t, jq.HandleJson(`{"a": ["x"]}`))
+	equals(t, true, jq.Next())
+	jq.Value()
+	// as if a key taken while iterating were never freed
+	leaked := jvString("key")
+	freed := jvString("freed")
+	freeJv(freed)
+	jq.Close()
+
+	stacks := LeakedAllocations()
+	equals(t, before+1, len(stacks))
+	found := false
+	for _, stack := range stacks {
+		found = found || strings.Contains(stack, "TestLeakedAllocations")
+	}
+	assert(t, found, "expected the leak to be traced to the test, got %v", stacks)
+
+	freeJv(leaked)
+	jq, err = NewJQ(".")
+	ok(t, err)
+	jq.Close()
+	equals(t, before, len(LeakedAllocations()))
+}
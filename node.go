@@ -0,0 +1,129 @@
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"sort"
+)
+
+// Node is a lossless tree form of a jq value, for callers such as editors
+// that must write back what they read. Unlike the maps and slices Value
+// returns, it keeps the order of object keys, the text of numbers, and
+// whether a key holding null is present at all.
+type Node struct {
+	// Kind is the jq type name: "null", "boolean", "number", "string",
+	// "array" or "object".
+	Kind string
+
+	Bool bool
+	// Number is the number as jq prints it. From jq 1.7 that is the literal
+	// from the input when the program left it untouched.
+	Number string
+	String string
+	Items  []Node
+	Fields []NodeField
+}
+
+// NodeField is one key of an object Node.
+type NodeField struct {
+	Key   string
+	Value Node
+}
+
+// ValueNode returns the current output as a Node. Object keys are in the
+// order the program built them, or sorted if SetSortKeys is on.
+func (jq *JQ) ValueNode() Node {
+	return jvToNode(jq.lastValue, jq.sortKeys)
+}
+
+// Get returns the value of key in an object Node, and whether it is
+// present. It returns false for any other kind of Node.
+func (n Node) Get(key string) (Node, bool) {
+	for _, f := range n.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return Node{}, false
+}
+
+// MarshalJSON encodes n as compact JSON the way jq prints it, numbers as
+// recorded in Number and keys in order.
+func (n Node) MarshalJSON() ([]byte, error) {
+	return n.appendJson(nil), nil
+}
+
+func (n Node) appendJson(dst []byte) []byte {
+	switch n.Kind {
+	case "boolean":
+		if n.Bool {
+			return append(dst, "true"...)
+		}
+		return append(dst, "false"...)
+	case "number":
+		return append(dst, n.Number...)
+	case "string":
+		return append(dst, QuoteString(n.String)...)
+	case "array":
+		dst = append(dst, '[')
+		for i, item := range n.Items {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = item.appendJson(dst)
+		}
+		return append(dst, ']')
+	case "object":
+		dst = append(dst, '{')
+		for i, f := range n.Fields {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, QuoteString(f.Key)...)
+			dst = append(dst, ':')
+			dst = f.Value.appendJson(dst)
+		}
+		return append(dst, '}')
+	default:
+		return append(dst, "null"...)
+	}
+}
+
+// jvToNode borrows jv.
+func jvToNode(jv C.jv, sortKeys bool) Node {
+	switch kind := C.jv_get_kind(jv); kind {
+	case C.JV_KIND_TRUE, C.JV_KIND_FALSE:
+		return Node{Kind: "boolean", Bool: kind == C.JV_KIND_TRUE}
+	case C.JV_KIND_NUMBER:
+		if _, ok := jsonFloat(jv); !ok {
+			// NaN prints as null
+			return Node{Kind: "null"}
+		}
+		return Node{Kind: "number", Number: dumpJson(jv)}
+	case C.JV_KIND_STRING:
+		return Node{Kind: "string", String: jvGoString(jv)}
+	case C.JV_KIND_ARRAY:
+		n := Node{Kind: "array", Items: make([]Node, int(C.jv_array_length(C.jv_copy(jv))))}
+		for i := range n.Items {
+			item := trackJv(C.jv_array_get(C.jv_copy(jv), C.int(i)))
+			n.Items[i] = jvToNode(item, sortKeys)
+			freeJv(item)
+		}
+		return n
+	case C.JV_KIND_OBJECT:
+		n := Node{Kind: "object", Fields: []NodeField{}}
+		for i := C.jv_object_iter(jv); C.jv_object_iter_valid(jv, i) != 0; i = C.jv_object_iter_next(jv, i) {
+			k := trackJv(C.jv_object_iter_key(jv, i))
+			v := trackJv(C.jv_object_iter_value(jv, i))
+			n.Fields = append(n.Fields, NodeField{jvGoString(k), jvToNode(v, sortKeys)})
+			freeJv(k)
+			freeJv(v)
+		}
+		if sortKeys {
+			sort.Slice(n.Fields, func(i, j int) bool { return n.Fields[i].Key < n.Fields[j].Key })
+		}
+		return n
+	default:
+		return Node{Kind: "null"}
+	}
+}
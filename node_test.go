@@ -0,0 +1,46 @@
+package jq
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValueNode(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	text := `{"z":null,"a":[1.5,"s\n\u007f",true,{}],"m":{"k":[]}}`
+	ok(t, jq.HandleJson(text))
+	equals(t, true, jq.Next())
+	n := jq.ValueNode()
+
+	equals(t, "object", n.Kind)
+	equals(t, []string{"z", "a", "m"}, []string{n.Fields[0].Key, n.Fields[1].Key, n.Fields[2].Key})
+	z, present := n.Get("z")
+	equals(t, true, present)
+	equals(t, "null", z.Kind)
+	_, present = n.Get("y")
+	equals(t, false, present)
+
+	a, _ := n.Get("a")
+	equals(t, Node{Kind: "array", Items: []Node{
+		{Kind: "number", Number: "1.5"},
+		{Kind: "string", String: "s\n\x7f"},
+		{Kind: "boolean", Bool: true},
+		{Kind: "object", Fields: []NodeField{}},
+	}}, a)
+
+	out, err := json.Marshal(n)
+	ok(t, err)
+	equals(t, text, string(out))
+	equals(t, jq.ValueJson(), string(out))
+
+	jq.SetSortKeys(true)
+	out, err = n.MarshalJSON()
+	ok(t, err)
+	equals(t, text, string(out))
+	out, err = jq.ValueNode().MarshalJSON()
+	ok(t, err)
+	equals(t, jq.ValueJson(), string(out))
+}
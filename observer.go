@@ -0,0 +1,73 @@
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"io"
+	"time"
+)
+
+// Observer receives timings for a JQ instance, e.g. to export as metrics.
+// Its methods are called synchronously from the goroutine using the
+// instance, so they should be quick.
+type Observer interface {
+	// OnCompile is called once the program has been compiled, or has
+	// failed to compile.
+	OnCompile(dur time.Duration, err error)
+	// OnInput is called when the outputs for an input come to an end,
+	// either because they ran out or because the instance moved on before
+	// they did. dur is the time spent inside jq producing them, outputs how
+	// many were produced and err the error that ended them, if any. An
+	// input that Handle fails to convert is reported with no outputs.
+	OnInput(dur time.Duration, outputs int, err error)
+}
+
+// WithObserver reports compile and per-input timings to obs.
+func WithObserver(obs Observer) Option {
+	return func(jq *JQ) error {
+		jq.observer = obs
+		return nil
+	}
+}
+
+// inputStats tracks the input being processed for the observer.
+type inputStats struct {
+	active  bool
+	busy    time.Duration
+	outputs int
+}
+
+// endInput reports the current input to the observer, if it has not been
+// already.
+func (jq *JQ) endInput(err error) {
+	if jq.observer == nil || !jq.stats.active {
+		return
+	}
+	jq.stats.active = false
+	jq.observer.OnInput(jq.stats.busy, jq.stats.outputs, err)
+}
+
+// WithInputRecorder writes every input the program is started on to w as a
+// line of compact JSON. The result can be fed back through StreamJSON to
+// reproduce a problem offline. Errors writing to w are ignored, so that
+// recording never disturbs the processing itself.
+func WithInputRecorder(w io.Writer) Option {
+	return func(jq *JQ) error {
+		jq.recorder = &inputRecorder{w: w}
+		return nil
+	}
+}
+
+type inputRecorder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// record borrows v. It does nothing on a nil recorder.
+func (r *inputRecorder) record(v C.jv) {
+	if r == nil {
+		return
+	}
+	r.buf = append(appendJsonFlags(r.buf[:0], v, 0), '\n')
+	r.w.Write(r.buf)
+}
@@ -0,0 +1,83 @@
+package jq
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	compiles []string
+	inputs   []string
+}
+
+func (o *recordingObserver) OnCompile(dur time.Duration, err error) {
+	o.compiles = append(o.compiles, fmt.Sprint(dur >= 0, err != nil))
+}
+
+func (o *recordingObserver) OnInput(dur time.Duration, outputs int, err error) {
+	o.inputs = append(o.inputs, fmt.Sprintf("%v %d %v", dur >= 0, outputs, err))
+}
+
+func TestObserver(t *testing.T) {
+	obs := &recordingObserver{}
+	jq, err := NewJQ(".[] | 10 / .", WithObserver(obs))
+	ok(t, err)
+	equals(t, []string{"true false"}, obs.compiles)
+
+	jq.Handle([]int{1, 2})
+	_, err = jq.All()
+	ok(t, err)
+
+	// an error ends the outputs
+	jq.Handle([]interface{}{5, "x"})
+	_, err = jq.All()
+	assert(t, err != nil, "expected a runtime error")
+
+	// moving on early, by handling another input, resetting or closing
+	jq.Handle([]int{1, 2})
+	jq.Next()
+	ok(t, jq.HandleJson(`[1]`))
+	jq.Reset()
+	jq.Handle(uintptr(1))
+	jq.Handle([]int{1})
+	jq.Close()
+
+	equals(t, []string{
+		"true 2 <nil>",
+		"true 1 number (10) and string (\"x\") cannot be divided",
+		"true 1 <nil>",
+		"true 0 <nil>",
+		"true 0 uintptr cannot be encoded",
+		"true 0 <nil>",
+	}, obs.inputs)
+}
+
+func TestObserverCompileError(t *testing.T) {
+	obs := &recordingObserver{}
+	_, err := NewJQ(".[", WithObserver(obs))
+	assert(t, err != nil, "expected a compile error")
+	equals(t, []string{"true true"}, obs.compiles)
+	equals(t, 0, len(obs.inputs))
+}
+
+func TestInputRecorder(t *testing.T) {
+	var recorded bytes.Buffer
+	jq, err := NewJQ(".a", WithInputRecorder(&recorded))
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(map[string]int{"a": 1})
+	ok(t, jq.HandleJson(`{"a": [2, "x"]}`))
+	jq.Handle(uintptr(1))
+	jq.Handle("oops")
+	equals(t, false, jq.Next())
+	assert(t, jq.Err() != nil, "expected a runtime error")
+	equals(t, "{\"a\":1}\n{\"a\":[2,\"x\"]}\n\"oops\"\n", recorded.String())
+
+	// the recording replays the same inputs
+	var out bytes.Buffer
+	assert(t, StreamJSON(".a", &recorded, &out) != nil, "expected the replay to fail the same way")
+	equals(t, "1\n[2,\"x\"]\n", out.String())
+}
@@ -0,0 +1,263 @@
+package jq
+
+// #include <jq.h>
+// #include <jv.h>
+import "C"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Option configures a JQ instance before its program is compiled.
+type Option func(*JQ) error
+
+// WithArg binds value to the variable $name in the program, like jq's --arg
+// for strings and --argjson for other values. The value is converted in the
+// same way as one passed to Handle. Binding values as arguments rather than
+// splicing them into the program text avoids any need for escaping.
+//
+// Arguments are converted and bound once, when the program is compiled.
+// The instance can then Handle any number of inputs with the same
+// arguments at no further cost; later changes to value are not seen. To
+// run with different arguments, compile another instance.
+func WithArg(name string, value interface{}) Option {
+	return func(jq *JQ) error {
+		if jq.args == nil {
+			jq.args = make(map[string]interface{})
+		}
+		jq.args[name] = value
+		return nil
+	}
+}
+
+// WithArgJSON binds the value of the JSON text to $name, like jq's
+// --argjson. The text must hold exactly one JSON value. jq parses it
+// itself, so object keys keep their order and numbers are as jq reads them.
+func WithArgJSON(name, text string) Option {
+	return WithArg(name, jsonArg{text: []byte(text)})
+}
+
+// WithSlurpFile binds an array of the JSON values in the file at path to
+// $name, like jq's --slurpfile. The file is read when the option is
+// applied, and parsed by jq as for WithArgJSON.
+func WithSlurpFile(name, path string) Option {
+	return func(jq *JQ) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("argument $%s: %v", name, err)
+		}
+		return WithArg(name, jsonArg{text: data, slurp: true, source: path})(jq)
+	}
+}
+
+// WithRawFile binds the contents of the file at path to $name as a string,
+// like jq's --rawfile. The file is read when the option is applied.
+func WithRawFile(name, path string) Option {
+	return func(jq *JQ) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("argument $%s: %v", name, err)
+		}
+		return WithArg(name, string(data))(jq)
+	}
+}
+
+// jsonArg is an argument given as JSON text, which is parsed straight into
+// a jv when the program is compiled rather than going through Go values.
+type jsonArg struct {
+	text   []byte
+	slurp  bool   // bind an array of every value in text
+	source string // where text came from, for errors
+}
+
+func (a jsonArg) parse() (C.jv, error) {
+	if !a.slurp {
+		return parseJsonBytes(a.text)
+	}
+	input := newJsonStream(bytes.NewReader(a.text), 0)
+	defer input.close()
+	arr := C.jv_array()
+	for {
+		v, err := input.next()
+		if err == io.EOF {
+			return trackJv(arr), nil
+		}
+		if err != nil {
+			freeJv(arr)
+			return C.jv_invalid(), fmt.Errorf("%s: %v", a.source, err)
+		}
+		arr = C.jv_array_append(arr, v)
+	}
+}
+
+// WithInputs feeds the input and inputs builtins with the JSON values read
+// from r, as the command line tool feeds them with the values after the
+// current one. r is read ahead in large chunks, so it is consumed beyond
+// the values taken, and InputsRead counts only those taken for the current
+// input. Without this option input fails and inputs is empty.
+func WithInputs(r io.Reader) Option {
+	return func(jq *JQ) error {
+		if jq.inputs != nil {
+			jq.inputs.close()
+		}
+		jq.inputs = newJsonStream(r, 0)
+		return nil
+	}
+}
+
+// OnErrorPassthrough makes a runtime error output the input unchanged,
+// instead of stopping the outputs with the error, so that every input
+// produces something: Next returns the input as the last output for it and
+// Err stays nil. Outputs produced before the error are kept, so a caller
+// that needs exactly one output per input should make the program produce
+// one. An Observer is still told of the error.
+func OnErrorPassthrough() Option {
+	return func(jq *JQ) error {
+		jq.passthrough = true
+		return nil
+	}
+}
+
+// WithStringNormalizer makes Value, ValueTyped and ValueInto pass every
+// string they decode, object keys included, through normalize. It lets
+// strings from sources that mix Unicode normalization forms compare equal in
+// Go, e.g. with norm.NFC.String from golang.org/x/text/unicode/norm. jq
+// itself compares strings byte for byte and is unaffected.
+func WithStringNormalizer(normalize func(string) string) Option {
+	return func(jq *JQ) error {
+		jq.decode.normalize = normalize
+		return nil
+	}
+}
+
+// UntrustedDenylist names the builtins that let a program look outside the
+// values it is given: the environment, further inputs, the module system
+// and jq's own files, and stderr. Pass it to WithDenylist to run filters
+// from untrusted sources.
+var UntrustedDenylist = []string{
+	"env", "$ENV", "input", "inputs", "input_filename", "input_line_number",
+	"debug", "stderr", "halt", "halt_error", "import", "include", "modulemeta",
+	"get_search_list", "get_prog_origin", "get_jq_origin",
+}
+
+// WithDenylist rejects programs that use any of the given names, before
+// compiling them. Names are functions such as "env", variables with their
+// $ such as "$ENV", or the keywords "import" and "include". A function is
+// rejected whatever its arity, and even if the program defines its own
+// function of that name. Object keys, field names and strings that merely
+// contain a name are allowed.
+func WithDenylist(names ...string) Option {
+	return func(jq *JQ) error {
+		if jq.denylist == nil {
+			jq.denylist = make(map[string]bool)
+		}
+		for _, name := range names {
+			jq.denylist[name] = true
+		}
+		return nil
+	}
+}
+
+// checkDenylist returns an error if program uses a denied name.
+func (jq *JQ) checkDenylist(program string) error {
+	if len(jq.denylist) == 0 {
+		return nil
+	}
+	tokens, ok := lexJq(program)
+	if !ok {
+		return errors.New("Unable to compile jq filter: unterminated string or interpolation")
+	}
+	var brackets []string
+	for i, tok := range tokens {
+		switch tok.kind {
+		case tokPunct:
+			switch tok.text {
+			case "(", `\(`, "[", "{":
+				brackets = append(brackets, tok.text)
+			case ")", "]", "}":
+				if len(brackets) > 0 {
+					brackets = brackets[:len(brackets)-1]
+				}
+			}
+			continue
+		case tokIdent, tokKeyword, tokVar:
+		default:
+			continue
+		}
+		// the key of an object, other than shorthand such as {$ENV}
+		inObject := len(brackets) > 0 && brackets[len(brackets)-1] == "{"
+		if inObject && tok.kind != tokVar && i+1 < len(tokens) && tokens[i+1].text == ":" {
+			if p := tokens[i-1].text; p == "{" || p == "," {
+				continue
+			}
+		}
+		if jq.denylist[tok.text] {
+			return fmt.Errorf("Unable to compile jq filter: %s is not allowed", tok.text)
+		}
+	}
+	return nil
+}
+
+// compileArgs converts the bound arguments into the object expected by
+// jq_compile_args, which takes ownership of it.
+func (jq *JQ) compileArgs() (C.jv, error) {
+	args := C.jv_object()
+	for name, value := range jq.args {
+		if arg, ok := value.(jsonArg); ok {
+			v, err := arg.parse()
+			if err != nil {
+				freeJv(args)
+				return C.jv_invalid(), fmt.Errorf("argument $%s: %v", name, err)
+			}
+			args = C.jv_object_set(args, jvString(name), v)
+			continue
+		}
+		v := trackJv(newEncoder(jq.maxDepth).encode(value))
+		if !isValid(v) {
+			err := invalidError(v)
+			freeJv(v)
+			freeJv(args)
+			return C.jv_invalid(), fmt.Errorf("argument $%s: %v", name, err)
+		}
+		args = C.jv_object_set(args, jvString(name), v)
+	}
+	return args, nil
+}
+
+// WithAttr sets a jq attribute before the program is compiled, as SetAttr
+// does. Attributes that affect compilation, such as JQ_LIBRARY_PATH, only
+// take effect when set this way.
+func WithAttr(key string, value interface{}) Option {
+	return func(jq *JQ) error {
+		return jq.SetAttr(key, value)
+	}
+}
+
+// SetAttr sets one of the attributes jq keeps on its state, converting the
+// value as Handle does. Which attributes exist depends on the linked jq;
+// jq 1.6 reads JQ_LIBRARY_PATH (an array of module search directories),
+// JQ_ORIGIN and PROGRAM_ORIGIN when resolving imports.
+func (jq *JQ) SetAttr(key string, value interface{}) error {
+	v := trackJv(newEncoder(jq.maxDepth).encode(value))
+	if !isValid(v) {
+		err := invalidError(v)
+		freeJv(v)
+		return fmt.Errorf("attribute %s: %v", key, err)
+	}
+	C.jq_set_attr(jq.state, jvString(key), v)
+	jq.attrsChanged = true
+	return nil
+}
+
+// GetAttr returns the value of a jq attribute, or nil if it is not set.
+func (jq *JQ) GetAttr(key string) interface{} {
+	v := C.jq_get_attr(jq.state, jvString(key))
+	defer freeJv(v)
+	if !isValid(v) {
+		return nil
+	}
+	return jvToGo(v)
+}
@@ -0,0 +1,277 @@
+package jq
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithArg(t *testing.T) {
+	jq, err := NewJQ("[$name, $n, $obj.a, .]", WithArg("name", "x"), WithArg("n", 2), WithArg("obj", map[string]int{"a": 3}))
+	ok(t, err)
+	defer jq.Close()
+
+	for _, input := range []int{1, 2} {
+		jq.Handle(input)
+		equals(t, true, jq.Next())
+		equals(t, []interface{}{"x", 2, 3, input}, jq.Value())
+	}
+}
+
+func TestWithFileArgs(t *testing.T) {
+	dir := t.TempDir()
+	values, raw := filepath.Join(dir, "values.json"), filepath.Join(dir, "raw.txt")
+	ok(t, os.WriteFile(values, []byte("1 {\"a\": [2]}\n\"x\""), 0o644))
+	ok(t, os.WriteFile(raw, []byte("line\n"), 0o644))
+	empty := filepath.Join(dir, "empty.json")
+	ok(t, os.WriteFile(empty, nil, 0o644))
+
+	jq, err := NewJQ("[$json, $values, $raw, $empty]",
+		WithArgJSON("json", `{"b": null}`), WithSlurpFile("values", values), WithRawFile("raw", raw), WithSlurpFile("empty", empty))
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	equals(t, `[{"b":null},[1,{"a":[2]},"x"],"line\n",[]]`, jq.ValueJson())
+
+	// jq parses the text itself, keeping key order and reading numbers as
+	// the command line tool does
+	jq2, err := NewJQ("[$obj, $values]",
+		WithArgJSON("obj", `{"z": 1, "b": 2, "y": 3, "a": 12345678901234567890, "m": 0.1}`),
+		WithSlurpFile("values", values))
+	ok(t, err)
+	defer jq2.Close()
+	jq2.Handle(nil)
+	equals(t, true, jq2.Next())
+	equals(t, `[{"z":1,"b":2,"y":3,"a":12345678901234567000,"m":0.1},[1,{"a":[2]},"x"]]`, jq2.ValueJson())
+
+	for _, opt := range []Option{
+		WithArgJSON("x", "1 2"),
+		WithArgJSON("x", ""),
+		WithArgJSON("x", "{"),
+		WithSlurpFile("x", raw),
+		WithSlurpFile("x", filepath.Join(dir, "missing.json")),
+		WithRawFile("x", filepath.Join(dir, "missing.txt")),
+	} {
+		_, err := NewJQ("$x", opt)
+		assert(t, err != nil && strings.HasPrefix(err.Error(), "argument $x: "), "expected an argument error, got %v", err)
+	}
+}
+
+func TestWithArgBoundOnce(t *testing.T) {
+	config := map[string]interface{}{"factor": 2}
+	jq, err := NewJQ(". * $config.factor", WithArg("config", config))
+	ok(t, err)
+	defer jq.Close()
+
+	// the argument was converted at compile time
+	config["factor"] = 3
+	for i := 0; i < 1000; i++ {
+		jq.Handle(i)
+		equals(t, true, jq.Next())
+		if v := jq.Value(); v != 2*i {
+			t.Fatalf("got %v for input %d", v, i)
+		}
+	}
+}
+
+func TestWithInputs(t *testing.T) {
+	jq, err := NewJQ("[., limit(.; inputs)]", WithInputs(strings.NewReader("10 20 30 40 50")))
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(2)
+	equals(t, true, jq.Next())
+	equals(t, []interface{}{2, 10, 20}, jq.Value())
+	equals(t, 2, jq.InputsRead())
+
+	jq.Handle(1)
+	equals(t, true, jq.Next())
+	equals(t, []interface{}{1, 30}, jq.Value())
+	equals(t, 1, jq.InputsRead())
+
+	jq.Handle(5)
+	equals(t, true, jq.Next())
+	equals(t, []interface{}{5, 40, 50}, jq.Value())
+	equals(t, 2, jq.InputsRead())
+
+	jq.Handle(1)
+	equals(t, true, jq.Next())
+	equals(t, []interface{}{1}, jq.Value())
+	equals(t, 0, jq.InputsRead())
+}
+
+func TestWithInputsReduce(t *testing.T) {
+	jq, err := NewJQ("reduce inputs as $x (.; . + $x)", WithInputs(strings.NewReader("1 2 3")))
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(100)
+	equals(t, true, jq.Next())
+	equals(t, 106, jq.Value())
+	equals(t, 3, jq.InputsRead())
+
+	// without WithInputs there is nothing to read
+	values, err := Run[int]("reduce inputs as $x (.; . + $x)", 100)
+	ok(t, err)
+	equals(t, []int{100}, values)
+}
+
+func TestOnErrorPassthrough(t *testing.T) {
+	jq, err := NewJQ(".a + 1", OnErrorPassthrough())
+	ok(t, err)
+	defer jq.Close()
+
+	var out bytes.Buffer
+	for _, input := range []string{`{"a": 1}`, `{"a": "x"}`, `[1]`, `{"a": 2}`} {
+		ok(t, jq.HandleJson(input))
+		ok(t, jq.WriteAll(&out))
+	}
+	equals(t, "2\n{\"a\":\"x\"}\n[1]\n3\n", out.String())
+
+	// the source carries on after a failed input
+	var values []interface{}
+	jq.HandleFrom(counter(2))
+	for jq.Next() {
+		values = append(values, jq.Value())
+	}
+	ok(t, jq.Err())
+	equals(t, []interface{}{0, 1}, values)
+}
+
+func TestWithArgOverride(t *testing.T) {
+	jq, err := NewJQ("$x", WithArg("x", 1), WithArg("x", 2))
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	equals(t, 2, jq.Value())
+}
+
+func TestWithArgNotEscaped(t *testing.T) {
+	jq, err := NewJQ("$s", WithArg("s", `") | env | ("`))
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	equals(t, `") | env | ("`, jq.Value())
+}
+
+func TestWithArgUnbound(t *testing.T) {
+	_, err := NewJQ("$missing", WithArg("x", 1))
+	assert(t, err != nil, "expected a compile error")
+}
+
+func TestWithArgInvalid(t *testing.T) {
+	_, err := NewJQ("$x", WithArg("x", make(chan int)))
+	assert(t, err != nil, "expected an encoding error")
+	equals(t, "argument $x: unknown type for: ", err.Error()[:len("argument $x: unknown type for: ")])
+}
+
+func TestWithAttrLibraryPath(t *testing.T) {
+	dir := t.TempDir()
+	ok(t, os.WriteFile(filepath.Join(dir, "util.jq"), []byte(`def double: . * 2;`), 0o644))
+
+	jq, err := NewJQ(`import "util" as util; util::double`, WithAttr("JQ_LIBRARY_PATH", []string{dir}))
+	ok(t, err)
+	defer jq.Close()
+	equals(t, []interface{}{dir}, jq.GetAttr("JQ_LIBRARY_PATH"))
+
+	jq.Handle(21)
+	equals(t, true, jq.Next())
+	equals(t, 42, jq.Value())
+}
+
+func TestSetAttr(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	equals(t, nil, jq.GetAttr("CUSTOM"))
+	ok(t, jq.SetAttr("CUSTOM", map[string]int{"a": 1}))
+	equals(t, map[string]interface{}{"a": 1}, jq.GetAttr("CUSTOM"))
+
+	assert(t, jq.SetAttr("CUSTOM", make(chan int)) != nil, "expected an encoding error")
+	equals(t, map[string]interface{}{"a": 1}, jq.GetAttr("CUSTOM"))
+}
+
+func TestWithStringNormalizer(t *testing.T) {
+	// stands in for norm.NFC.String for the one character used here
+	nfc := func(s string) string { return strings.ReplaceAll(s, "e\u0301", "\u00e9") }
+	jq, err := NewJQ(".", WithStringNormalizer(nfc))
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson("{\"cafe\u0301\": [\"cafe\u0301\", 1]}")
+	equals(t, true, jq.Next())
+	equals(t, map[string]interface{}{"caf\u00e9": []interface{}{"caf\u00e9", 1}}, jq.Value())
+
+	var decoded map[string][]interface{}
+	ok(t, jq.ValueInto(&decoded))
+	equals(t, map[string][]interface{}{"caf\u00e9": {"caf\u00e9", 1}}, decoded)
+
+	// jq itself still sees the original bytes
+	equals(t, "{\"cafe\u0301\":[\"cafe\u0301\",1]}", jq.ValueJson())
+}
+
+func TestWithDenylist(t *testing.T) {
+	for _, program := range []string{
+		`env`,
+		`$ENV.HOME`,
+		`$ ENV.HOME`,
+		"$ # a comment\nENV.HOME",
+		`{$ENV}`,
+		`[inputs]`,
+		`"\(env.HOME)"`,
+		`.[0, env:1]`,
+		`{a: env}`,
+		`import "x" as x; 1`,
+	} {
+		_, err := NewJQ(program, WithDenylist(UntrustedDenylist...))
+		assert(t, err != nil && strings.HasSuffix(err.Error(), "is not allowed"), "expected %q to be rejected, got %v", program, err)
+	}
+
+	for _, program := range []string{
+		`.env`,
+		`{env: 1, input: 2} | .env + .input`,
+		`"env and $ENV"`,
+		`.["inputs"]`,
+	} {
+		jq, err := NewJQ(program, WithDenylist(UntrustedDenylist...))
+		ok(t, err)
+		jq.Close()
+	}
+
+	_, err := NewJQ(`length`, WithDenylist("length"))
+	equals(t, "Unable to compile jq filter: length is not allowed", fmt.Sprint(err))
+}
+
+func TestWithTimezone(t *testing.T) {
+	program := `localtime | strflocaltime("%Y-%m-%d %H:%M %Z")`
+	jq, err := NewJQ(program, WithTimezone("Asia/Tokyo"))
+	ok(t, err)
+	defer jq.Close()
+	jq.Handle(1700000000)
+	equals(t, true, jq.Next())
+	equals(t, "2023-11-15 07:13 JST", jq.Value())
+
+	// the zone does not leak into other instances
+	t.Setenv("TZ", "UTC")
+	utc, err := NewJQ(program)
+	ok(t, err)
+	defer utc.Close()
+	jq.Handle(1700000000)
+	utc.Handle(1700000000)
+	equals(t, true, jq.Next())
+	equals(t, true, utc.Next())
+	equals(t, "2023-11-15 07:13 JST", jq.Value())
+	equals(t, "2023-11-14 22:13 UTC", utc.Value())
+
+	_, err = NewJQ(".", WithTimezone("Nowhere/Special"))
+	assert(t, err != nil, "expected an unknown zone to be rejected")
+}
@@ -0,0 +1,256 @@
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// OutputOptions controls how outputs are formatted by ValueJson,
+// AppendValueJson and WriteAll. The zero value gives compact JSON.
+type OutputOptions struct {
+	// Pretty indents output with two spaces, like jq's default output.
+	Pretty bool
+	// Indent sets the number of spaces per level, like jq --indent. jq
+	// supports at most 7. It implies Pretty; zero means the default of two.
+	Indent int
+	// Tab indents with one tab per level, like jq --tab. It implies Pretty
+	// and takes precedence over Indent.
+	Tab bool
+	// Color highlights output with ANSI escapes, like jq -C.
+	Color bool
+	// CanonicalNumbers rewrites numbers as CanonicalizeNumbers does, so
+	// output does not depend on how the linked libjq prints them. This
+	// also reformats number literals that jq 1.7 would pass through as is.
+	CanonicalNumbers bool
+	// Raw makes WriteAll write string outputs as their contents rather than
+	// as JSON strings, like jq -r. Other outputs are still JSON.
+	Raw bool
+	// RawOutput0 is Raw with each output followed by a NUL byte instead of
+	// a newline, like jq --raw-output0, for xargs -0 and the like. A string
+	// that itself contains NUL stops WriteAll with an error.
+	RawOutput0 bool
+	// TrailingNewline ends the text from ValueJson, AppendValueJson and
+	// ValueString with a newline, as jq prints each output, so it can be
+	// compared byte for byte with the command line tool's. WriteAll and the
+	// other writers separate outputs themselves and are unaffected.
+	TrailingNewline bool
+	// FlushEvery makes WriteAll call the writer's Flush method, if it has
+	// one such as bufio.Writer's or http.Flusher's, after every FlushEvery
+	// outputs and after the last, trading latency for fewer writes. Zero
+	// leaves flushing to the caller.
+	FlushEvery int
+}
+
+// SetOutputOptions sets how the instance formats its outputs. It returns an
+// error, leaving the options unchanged, if Indent is outside 0 to 7.
+func (jq *JQ) SetOutputOptions(opts OutputOptions) error {
+	if opts.Indent < 0 || opts.Indent > 7 {
+		return errors.New("Cannot indent more than 7 characters")
+	}
+	jq.output = opts
+	return nil
+}
+
+// WriteAll writes every remaining output for the current input to w, each
+// followed by a newline as the jq command line tool does.
+func (jq *JQ) WriteAll(w io.Writer) error {
+	raw := jq.output.Raw || jq.output.RawOutput0
+	sep := byte('\n')
+	if jq.output.RawOutput0 {
+		sep = 0
+	}
+	var buf []byte
+	unflushed := 0
+	for jq.Next() {
+		if raw && C.jv_get_kind(jq.lastValue) == C.JV_KIND_STRING {
+			buf = append(buf[:0], jvStringBytes(jq.lastValue)...)
+			if sep == 0 && bytes.IndexByte(buf, 0) >= 0 {
+				jq.drain()
+				return errors.New("Cannot write a string containing NUL with RawOutput0")
+			}
+		} else {
+			buf = jq.appendValueJson(buf[:0])
+		}
+		buf = append(buf, sep)
+		if _, err := w.Write(buf); err != nil {
+			jq.drain()
+			return err
+		}
+		if unflushed++; jq.output.FlushEvery > 0 && unflushed == jq.output.FlushEvery {
+			unflushed = 0
+			if err := flush(w); err != nil {
+				jq.drain()
+				return err
+			}
+		}
+	}
+	if unflushed > 0 && jq.output.FlushEvery > 0 {
+		if err := flush(w); err != nil {
+			return err
+		}
+	}
+	return jq.Err()
+}
+
+// WriteArray writes every remaining output for the current input to w as
+// the elements of a single JSON array followed by a newline, the equivalent
+// of wrapping the program in [...] but without holding the outputs in
+// memory. No outputs give []. If the program fails the array is left
+// unterminated and the error returned.
+func (jq *JQ) WriteArray(w io.Writer) error {
+	var buf []byte
+	sep := byte('[')
+	for jq.Next() {
+		buf = jq.appendValueJson(append(buf[:0], sep))
+		sep = ','
+		if _, err := w.Write(buf); err != nil {
+			jq.drain()
+			return err
+		}
+	}
+	if err := jq.Err(); err != nil {
+		return err
+	}
+	buf = buf[:0]
+	if sep == '[' {
+		buf = append(buf, '[')
+	}
+	_, err := w.Write(append(buf, ']', '\n'))
+	return err
+}
+
+// EncodeTo passes every remaining output for the current input to enc as
+// pre-encoded JSON, so it is written without first being converted to Go
+// values. The encoder's own settings, such as SetIndent and SetEscapeHTML,
+// decide the formatting; of the OutputOptions only CanonicalNumbers applies,
+// along with SetSortKeys. An error from enc stops the outputs and is
+// returned, otherwise the result is Err's.
+func (jq *JQ) EncodeTo(enc *json.Encoder) error {
+	var flags C.int
+	if jq.sortKeys {
+		flags = C.JV_PRINT_SORTED
+	}
+	var raw, canonical []byte
+	for jq.Next() {
+		raw = appendJsonFlags(raw[:0], jq.lastValue, flags)
+		if jq.output.CanonicalNumbers {
+			canonical = appendCanonicalNumbers(canonical[:0], raw)
+			raw, canonical = canonical, raw
+		}
+		if err := enc.Encode(json.RawMessage(raw)); err != nil {
+			jq.drain()
+			return err
+		}
+	}
+	return jq.Err()
+}
+
+// Marshal returns the compact JSON encoding of v, converted as Handle
+// converts its input and printed as jq prints its outputs, so it matches
+// output from jq byte for byte, numbers included. The keys of Go maps come
+// out sorted, as with encoding/json; OrderedMap keeps its own order.
+func Marshal(v interface{}) ([]byte, error) {
+	e := newEncoder(0)
+	e.sortMapKeys = true
+	jv := trackJv(e.encode(v))
+	defer freeJv(jv)
+	if !isValid(jv) {
+		return nil, invalidError(jv)
+	}
+	return appendJsonFlags(nil, jv, 0), nil
+}
+
+// ErrOutputTooLarge is wrapped by the error Err returns when an output
+// exceeds the limit set by SetMaxOutputSize.
+var ErrOutputTooLarge = errors.New("Output too large")
+
+// SetMaxOutputSize stops the outputs for an input, with an error wrapping
+// ErrOutputTooLarge, at the first output whose compact JSON encoding is
+// larger than size bytes. Zero, the default, means no limit.
+//
+// This is a best effort guard for running untrusted programs, not a
+// sandbox: the output is only measured once jq has built it, so a program
+// like [range(1e9)] can still exhaust memory before the check, and the
+// memory used along the way is not limited. Measuring costs about as much
+// as encoding each output.
+func (jq *JQ) SetMaxOutputSize(size int) {
+	jq.maxOutputSize = size
+}
+
+func (jq *JQ) checkOutputSize() error {
+	size := dumpedSize(jq.lastValue, 0)
+	if size > jq.maxOutputSize {
+		return fmt.Errorf("%w: %d bytes is more than the limit of %d", ErrOutputTooLarge, size, jq.maxOutputSize)
+	}
+	return nil
+}
+
+// ValueSize returns the length in bytes of the text ValueJson would return
+// for the current output, e.g. for a Content-Length header. The text is
+// measured where jq formats it, without being copied into Go.
+func (jq *JQ) ValueSize() int {
+	size := 0
+	if jq.output.CanonicalNumbers {
+		size = len(jq.appendValueJson(nil))
+	} else {
+		size = dumpedSize(jq.lastValue, jq.dumpFlags())
+	}
+	if jq.output.TrailingNewline {
+		size++
+	}
+	return size
+}
+
+// dumpedSize returns the length of jv's JSON text, borrowing jv.
+func dumpedSize(jv C.jv, flags C.int) int {
+	return int(C.jv_string_length_bytes(trackJv(C.jv_dump_string(C.jv_copy(jv), flags))))
+}
+
+// IsTerminal reports whether w is a terminal, for deciding whether to turn
+// on Color the way jq does for interactive output.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// appendValueJson formats the current output according to the options.
+func (jq *JQ) appendValueJson(dst []byte) []byte {
+	if !jq.output.CanonicalNumbers {
+		return appendJsonFlags(dst, jq.lastValue, jq.dumpFlags())
+	}
+	strJv := trackJv(C.jv_dump_string(C.jv_copy(jq.lastValue), jq.dumpFlags()))
+	dst = appendCanonicalNumbers(dst, jvStringBytes(strJv))
+	freeJv(strJv)
+	return dst
+}
+
+func (jq *JQ) dumpFlags() C.int {
+	var flags C.int
+	if jq.sortKeys {
+		flags |= C.JV_PRINT_SORTED
+	}
+	// the indent width lives in the JV_PRINT_SPACE bits, see
+	// JV_PRINT_INDENT_FLAGS
+	switch {
+	case jq.output.Tab:
+		flags |= C.JV_PRINT_PRETTY | C.JV_PRINT_TAB
+	case jq.output.Indent > 0:
+		flags |= C.JV_PRINT_PRETTY | C.int(jq.output.Indent)<<8
+	case jq.output.Pretty:
+		flags |= C.JV_PRINT_PRETTY | 2<<8
+	}
+	if jq.output.Color {
+		flags |= C.JV_PRINT_COLOR
+	}
+	return flags
+}
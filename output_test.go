@@ -0,0 +1,317 @@
+package jq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestWriteAll(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	var out bytes.Buffer
+	jq.HandleJson(`[1, {"a": "b"}, [null]]`)
+	ok(t, jq.WriteAll(&out))
+	equals(t, "1\n{\"a\":\"b\"}\n[null]\n", out.String())
+}
+
+func TestWriteAllRaw(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetOutputOptions(OutputOptions{Raw: true})
+	var out bytes.Buffer
+	jq.HandleJson(`["a b", "c\nd", 1, {"e": "f"}]`)
+	ok(t, jq.WriteAll(&out))
+	equals(t, "a b\nc\nd\n1\n{\"e\":\"f\"}\n", out.String())
+
+	jq.SetOutputOptions(OutputOptions{RawOutput0: true})
+	out.Reset()
+	jq.HandleJson(`["a b", "c\nd", 1]`)
+	ok(t, jq.WriteAll(&out))
+	equals(t, "a b\x00c\nd\x001\x00", out.String())
+
+	out.Reset()
+	jq.HandleJson(`["a", "b\u0000c", "d"]`)
+	equals(t, "Cannot write a string containing NUL with RawOutput0", jq.WriteAll(&out).Error())
+	equals(t, "a\x00", out.String())
+	equals(t, false, jq.Next())
+}
+
+func TestWriteAllPretty(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetOutputOptions(OutputOptions{Pretty: true})
+	var out bytes.Buffer
+	jq.HandleJson(`{"a": [1, 2], "b": {}}`)
+	ok(t, jq.WriteAll(&out))
+	equals(t, "{\n  \"a\": [\n    1,\n    2\n  ],\n  \"b\": {}\n}\n", out.String())
+}
+
+func TestTrailingNewline(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetOutputOptions(OutputOptions{Pretty: true, TrailingNewline: true})
+	jq.HandleJson(`[{"a": [1, 2]}, "s"]`)
+	equals(t, true, jq.Next())
+	equals(t, "{\n  \"a\": [\n    1,\n    2\n  ]\n}\n", jq.ValueJson())
+	equals(t, []byte("x{\n  \"a\": [\n    1,\n    2\n  ]\n}\n"), jq.AppendValueJson([]byte("x")))
+	equals(t, true, jq.Next())
+	equals(t, "\"s\"\n", jq.ValueJson())
+	equals(t, "s\n", jq.ValueString())
+
+	// writers add their own separators
+	var out bytes.Buffer
+	jq.SetOutputOptions(OutputOptions{TrailingNewline: true, CanonicalNumbers: true})
+	jq.HandleJson(`[1.0, "s"]`)
+	ok(t, jq.WriteAll(&out))
+	equals(t, "1\n\"s\"\n", out.String())
+}
+
+func TestValueSize(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	for _, opts := range []OutputOptions{
+		{},
+		{Pretty: true},
+		{Tab: true, TrailingNewline: true},
+		{CanonicalNumbers: true},
+	} {
+		ok(t, jq.SetOutputOptions(opts))
+		ok(t, jq.HandleJson(`[{"é": [1.0, 2]}, "s\u0000", 1e1000, null]`))
+		for jq.Next() {
+			equals(t, len(jq.ValueJson()), jq.ValueSize())
+		}
+		ok(t, jq.Err())
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	out, err := Marshal([]interface{}{3.0, 0.00001, 1e17, "é\n", nil, true})
+	ok(t, err)
+	equals(t, `[3,1e-05,1e+17,"é\n",null,true]`, string(out))
+
+	out, err = Marshal(map[string]int{"c": 3, "a": 1, "b": 2})
+	ok(t, err)
+	equals(t, `{"a":1,"b":2,"c":3}`, string(out))
+
+	out, err = Marshal(&orderedMap{keys: []string{"z", "a"}, values: map[string]interface{}{"z": 1, "a": 2}})
+	ok(t, err)
+	equals(t, `{"z":1,"a":2}`, string(out))
+
+	_, err = Marshal(make(chan int))
+	assert(t, err != nil, "expected an error for a channel")
+}
+
+// flushBatches records the writes made between flushes.
+type flushBatches struct {
+	pending int
+	batches []int
+}
+
+func (w *flushBatches) Write(p []byte) (int, error) {
+	w.pending++
+	return len(p), nil
+}
+
+func (w *flushBatches) Flush() {
+	w.batches = append(w.batches, w.pending)
+	w.pending = 0
+}
+
+func TestWriteAllFlushEvery(t *testing.T) {
+	jq, err := NewJQ("range(.)")
+	ok(t, err)
+	defer jq.Close()
+
+	w := &flushBatches{}
+	jq.SetOutputOptions(OutputOptions{FlushEvery: 3})
+	jq.Handle(7)
+	ok(t, jq.WriteAll(w))
+	equals(t, []int{3, 3, 1}, w.batches)
+
+	w = &flushBatches{}
+	jq.Handle(6)
+	ok(t, jq.WriteAll(w))
+	equals(t, []int{3, 3}, w.batches)
+
+	w = &flushBatches{}
+	jq.Handle(0)
+	ok(t, jq.WriteAll(w))
+	equals(t, 0, len(w.batches))
+
+	w = &flushBatches{}
+	jq.SetOutputOptions(OutputOptions{})
+	jq.Handle(5)
+	ok(t, jq.WriteAll(w))
+	equals(t, 0, len(w.batches))
+	equals(t, 5, w.pending)
+}
+
+func TestWriteAllColor(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetOutputOptions(OutputOptions{Color: true})
+	jq.HandleJson(`"s"`)
+	equals(t, true, jq.Next())
+	equals(t, "\x1b[0;32m\"s\"\x1b[0m", jq.ValueJson())
+}
+
+func TestWriteAllRuntimeError(t *testing.T) {
+	jq, err := NewJQ(".[] | .a")
+	ok(t, err)
+	defer jq.Close()
+
+	var out bytes.Buffer
+	jq.HandleJson(`[{"a": 1}, 2]`)
+	assert(t, jq.WriteAll(&out) != nil, "expected a runtime error")
+	equals(t, "1\n", out.String())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWriteAllWriterError(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.HandleJson(`[1, 2]`)
+	equals(t, "write failed", jq.WriteAll(failingWriter{}).Error())
+	equals(t, false, jq.Next())
+}
+
+func TestIsTerminal(t *testing.T) {
+	equals(t, false, IsTerminal(&bytes.Buffer{}))
+
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	ok(t, err)
+	defer f.Close()
+	equals(t, false, IsTerminal(f))
+
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		equals(t, true, IsTerminal(tty))
+	}
+}
+
+func assertFormatted(t *testing.T, opts OutputOptions, expected string) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.SetOutputOptions(opts))
+	jq.HandleJson(`{"a": [1]}`)
+	equals(t, true, jq.Next())
+	equals(t, expected, jq.ValueJson())
+}
+
+func TestOutputTab(t *testing.T) {
+	assertFormatted(t, OutputOptions{Tab: true}, "{\n\t\"a\": [\n\t\t1\n\t]\n}")
+}
+
+func TestOutputIndent(t *testing.T) {
+	assertFormatted(t, OutputOptions{Indent: 4}, "{\n    \"a\": [\n        1\n    ]\n}")
+	assertFormatted(t, OutputOptions{Indent: 7, Pretty: true}, "{\n       \"a\": [\n              1\n       ]\n}")
+	assertFormatted(t, OutputOptions{Indent: 1, Tab: true}, "{\n\t\"a\": [\n\t\t1\n\t]\n}")
+}
+
+func TestOutputIndentTooLarge(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	assert(t, jq.SetOutputOptions(OutputOptions{Indent: 8}) != nil, "expected an error for indent 8")
+	assert(t, jq.SetOutputOptions(OutputOptions{Indent: -1}) != nil, "expected an error for indent -1")
+
+	// the previous options are kept
+	jq.HandleJson(`[1]`)
+	equals(t, true, jq.Next())
+	equals(t, "[1]", jq.ValueJson())
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	jq, err := NewJQ(".[] | [range(.)]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetMaxOutputSize(10)
+	jq.Handle([]int{2, 3, 100, 1})
+	results := []interface{}{}
+	for jq.Next() {
+		results = append(results, jq.Value())
+	}
+	equals(t, []interface{}{[]interface{}{0, 1}, []interface{}{0, 1, 2}}, results)
+	assert(t, errors.Is(jq.Err(), ErrOutputTooLarge), "unexpected error: %v", jq.Err())
+	equals(t, "Output too large: 291 bytes is more than the limit of 10", jq.Err().Error())
+
+	jq.SetMaxOutputSize(0)
+	jq.Handle([]int{100})
+	equals(t, true, jq.Next())
+	ok(t, jq.Err())
+}
+
+func TestWriteArray(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	for input, expected := range map[string]string{
+		`[]`:                  "[]\n",
+		`[1]`:                 "[1]\n",
+		`[1, {"a": "x"}, []]`: "[1,{\"a\":\"x\"},[]]\n",
+	} {
+		var out bytes.Buffer
+		ok(t, jq.HandleJson(input))
+		ok(t, jq.WriteArray(&out))
+		equals(t, expected, out.String())
+	}
+
+	var out bytes.Buffer
+	jq.Handle(1)
+	assert(t, jq.WriteArray(&out) != nil, "expected a runtime error")
+	equals(t, "", out.String())
+
+	jq.Handle([]int{1, 2})
+	equals(t, "write failed", jq.WriteArray(failingWriter{}).Error())
+	equals(t, false, jq.Next())
+}
+
+func TestEncodeTo(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+	jq.SetSortKeys(true)
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetIndent("", " ")
+	ok(t, jq.HandleJson(`[{"b": "<", "a": 1.0}, [2]]`))
+	ok(t, jq.EncodeTo(enc))
+	equals(t, "{\n \"a\": 1,\n \"b\": \"\\u003c\"\n}\n[\n 2\n]\n", out.String())
+
+	jq.Handle(1)
+	out.Reset()
+	assert(t, jq.EncodeTo(json.NewEncoder(&out)) != nil, "expected a runtime error")
+	equals(t, "", out.String())
+
+	jq.Handle([]int{1, 2})
+	equals(t, "write failed", jq.EncodeTo(json.NewEncoder(failingWriter{})).Error())
+	equals(t, false, jq.Next())
+}
@@ -0,0 +1,47 @@
+package jq
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// QuoteString returns s as a jq string literal, so it can be spliced into a
+// program as a value, e.g. "select(.name == " + QuoteString(name) + ")".
+// Quotes, backslashes and control characters are escaped, which also keeps
+// \( from starting an interpolation. Invalid UTF-8 becomes U+FFFD, as jq
+// would read it.
+func QuoteString(s string) string {
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r < 0x20 || r == 0x7f:
+			b.WriteString(`\u00`)
+			b.WriteByte(hex[r>>4])
+			b.WriteByte(hex[r&0xf])
+		case r == utf8.RuneError && size == 1:
+			b.WriteString(`�`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,26 @@
+package jq
+
+import (
+	"testing"
+)
+
+func TestQuoteString(t *testing.T) {
+	equals(t, `"plain"`, QuoteString("plain"))
+	equals(t, `"say \"hi\" \\ \\(.x)"`, QuoteString(`say "hi" \ \(.x)`))
+	equals(t, `"a\nb\tc\r\b\f\u0000\u001f\u007f"`, QuoteString("a\nb\tc\r\b\f\x00\x1f\x7f"))
+	equals(t, `"héllo ☃ 😀"`, QuoteString("héllo ☃ 😀"))
+	equals(t, `"bad � byte"`, QuoteString("bad \xff byte"))
+
+	// jq reads each literal back as the original string
+	for _, s := range []string{
+		"", `"`, `\`, `\(env)`, `") | env | ("`, "line\nbreak", "\x00\x01\x7f", "  <&> 😀",
+	} {
+		outputs, err := RunJSON(QuoteString(s), "null")
+		ok(t, err)
+		equals(t, []string{QuoteString(s)}, outputs)
+
+		values, err := Run[string](". == "+QuoteString(s)+" | tostring", s)
+		ok(t, err)
+		equals(t, []string{"true"}, values)
+	}
+}
@@ -0,0 +1,116 @@
+package jq
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Registry holds compiled programs under names and runs them on request.
+// It is safe for concurrent use: each program keeps a pool of instances, so
+// concurrent runs of the same program each get their own. Instances are
+// compiled on demand and kept for reuse until the registry is closed.
+type Registry struct {
+	mu      sync.RWMutex
+	filters map[string]*registryEntry
+}
+
+type registryEntry struct {
+	program string
+	mu      sync.Mutex
+	idle    []*JQ
+	closed  bool
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{filters: make(map[string]*registryEntry)}
+}
+
+// Add compiles program and registers it as name, replacing any program
+// already registered under that name. Compile errors are returned and leave
+// the registry unchanged.
+func (r *Registry) Add(name, program string) error {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return err
+	}
+	entry := &registryEntry{program: program, idle: []*JQ{jq}}
+
+	r.mu.Lock()
+	old := r.filters[name]
+	r.filters[name] = entry
+	r.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// Run runs the program registered as name over input and returns all of its
+// outputs. As with All, outputs produced before an error are returned along
+// with it.
+func (r *Registry) Run(name string, input interface{}) ([]interface{}, error) {
+	r.mu.RLock()
+	entry := r.filters[name]
+	r.mu.RUnlock()
+	if entry == nil {
+		return nil, fmt.Errorf("No filter named %q", name)
+	}
+
+	jq, err := entry.get()
+	if err != nil {
+		return nil, err
+	}
+	defer entry.put(jq)
+
+	jq.Handle(input)
+	return jq.All()
+}
+
+// Close releases every instance held by the registry and empties it. Runs
+// still in progress finish normally.
+func (r *Registry) Close() {
+	r.mu.Lock()
+	filters := r.filters
+	r.filters = make(map[string]*registryEntry)
+	r.mu.Unlock()
+
+	for _, entry := range filters {
+		entry.close()
+	}
+}
+
+func (e *registryEntry) get() (*JQ, error) {
+	e.mu.Lock()
+	if n := len(e.idle); n > 0 {
+		jq := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.mu.Unlock()
+		return jq, nil
+	}
+	e.mu.Unlock()
+	return NewJQ(e.program)
+}
+
+// put returns an instance to the pool, or closes it if the entry has since
+// been replaced or the registry closed.
+func (e *registryEntry) put(jq *JQ) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		jq.Close()
+		return
+	}
+	e.idle = append(e.idle, jq)
+}
+
+func (e *registryEntry) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for _, jq := range e.idle {
+		jq.Close()
+	}
+	e.idle = nil
+}
@@ -0,0 +1,65 @@
+package jq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+
+	ok(t, r.Add("double", ".[] * 2"))
+	ok(t, r.Add("name", ".name"))
+	assert(t, r.Add("broken", ".[") != nil, "expected a compile error")
+
+	results, err := r.Run("double", []int{1, 2})
+	ok(t, err)
+	equals(t, []interface{}{2, 4}, results)
+
+	results, err = r.Run("name", map[string]string{"name": "x"})
+	ok(t, err)
+	equals(t, []interface{}{"x"}, results)
+
+	_, err = r.Run("broken", nil)
+	equals(t, `No filter named "broken"`, err.Error())
+
+	_, err = r.Run("name", 1)
+	assert(t, err != nil, "expected a runtime error")
+
+	ok(t, r.Add("name", ".id"))
+	results, err = r.Run("name", map[string]int{"id": 7})
+	ok(t, err)
+	equals(t, []interface{}{7}, results)
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	r := NewRegistry()
+	defer r.Close()
+	ok(t, r.Add("sum", "add"))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				results, err := r.Run("sum", []int{i, j})
+				if err == nil && (len(results) != 1 || results[0] != i+j) {
+					err = fmt.Errorf("unexpected results for %d+%d: %v", i, j, results)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		ok(t, err)
+	}
+}
@@ -0,0 +1,72 @@
+package jq
+
+import "sync"
+
+// Results sends the remaining outputs for the current input to the returned
+// channel as they are produced, closing it after the last one; Err then
+// reports whether the program failed. The channel holds up to buffer
+// values, and zero makes it unbuffered, so a slow consumer holds jq back
+// rather than letting outputs pile up: at most buffer+1 are produced ahead
+// of the consumer.
+//
+// The outputs are produced on another goroutine, so the JQ must not be
+// used again until the channel is closed. Call stop to finish early: it
+// discards the outputs not yet received and waits for the goroutine to
+// exit. Calling stop after the channel is closed, or more than once, is
+// harmless.
+func (jq *JQ) Results(buffer int) (results <-chan interface{}, stop func()) {
+	ch := make(chan interface{}, buffer)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(ch)
+		for jq.Next() {
+			select {
+			case ch <- jq.Value():
+			case <-quit:
+				jq.drain()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(quit) })
+		<-done
+	}
+	return ch, stop
+}
+
+// Iterator steps through the outputs for the current input as Values, so
+// each can be inspected, decoded or skipped without converting it to Go
+// first. It is a view of the JQ it came from: calling Next on either
+// advances both.
+type Iterator struct {
+	jq *JQ
+}
+
+// Iterator returns an Iterator over the remaining outputs for the current
+// input.
+func (jq *JQ) Iterator() *Iterator {
+	return &Iterator{jq}
+}
+
+// Next advances to the next output, returning false when there are no more
+// or the program failed; Err tells the two apart.
+func (it *Iterator) Next() bool {
+	return it.jq.Next()
+}
+
+// Value returns the current output. The caller owns it and must Free it,
+// whether or not it is used; it stays valid after Next and Close.
+func (it *Iterator) Value() Value {
+	return it.jq.ValueRef()
+}
+
+// Err returns the error that ended the outputs, or nil if they simply ran
+// out.
+func (it *Iterator) Err() error {
+	return it.jq.Err()
+}
@@ -0,0 +1,86 @@
+package jq
+
+import "testing"
+
+func TestResults(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]int{1, 2, 3})
+	results, stop := jq.Results(1)
+	defer stop()
+	equals(t, 1, cap(results))
+
+	var got []interface{}
+	for v := range results {
+		got = append(got, v)
+	}
+	equals(t, []interface{}{1, 2, 3}, got)
+	ok(t, jq.Err())
+}
+
+func TestResultsError(t *testing.T) {
+	jq, err := NewJQ(".[] | 10 / .")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]interface{}{5, "x"})
+	results, stop := jq.Results(0)
+	defer stop()
+
+	var got []interface{}
+	for v := range results {
+		got = append(got, v)
+	}
+	equals(t, []interface{}{2}, got)
+	assert(t, jq.Err() != nil, "expected a runtime error")
+}
+
+func TestResultsStop(t *testing.T) {
+	jq, err := NewJQ("range(1e15)")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle(nil)
+	results, stop := jq.Results(0)
+	equals(t, 0, <-results)
+	equals(t, 1, <-results)
+	stop()
+	stop()
+
+	// the instance is usable again
+	jq.Handle(nil)
+	equals(t, true, jq.Next())
+	equals(t, 0, jq.Value())
+}
+
+func TestIterator(t *testing.T) {
+	jq, err := NewJQ(".[] | 10 / .")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.Handle([]interface{}{1, 2, "x", 4})
+	it := jq.Iterator()
+	var kinds, values []string
+	for it.Next() {
+		v := it.Value()
+		kinds = append(kinds, v.Kind())
+		values = append(values, v.Json())
+		v.Free()
+	}
+	equals(t, []string{"number", "number"}, kinds)
+	equals(t, []string{"10", "5"}, values)
+	assert(t, it.Err() != nil, "expected a runtime error")
+
+	// values outlive the iterator's position
+	jq.Handle([]int{5, 10})
+	it = jq.Iterator()
+	equals(t, true, it.Next())
+	first := it.Value()
+	defer first.Free()
+	equals(t, true, it.Next())
+	equals(t, false, it.Next())
+	ok(t, it.Err())
+	equals(t, 2, first.ToGo())
+}
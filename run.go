@@ -0,0 +1,412 @@
+package jq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ProcessLines runs program over each line of r as a raw string, the
+// equivalent of `jq -R`, and returns all of the outputs in order.
+func ProcessLines(program string, r io.Reader) ([]interface{}, error) {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	var results []interface{}
+	reader := bufio.NewReader(r)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, readErr
+		}
+		if readErr == io.EOF && line == "" {
+			break
+		}
+
+		jq.Handle(strings.TrimSuffix(line, "\n"))
+		for jq.Next() {
+			results = append(results, jq.Value())
+		}
+		if err := jq.Err(); err != nil {
+			return nil, err
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+	return results, nil
+}
+
+// ProcessAll compiles program once and runs it over each of inputs. The
+// outputs for inputs[i] are returned in the i'th slice.
+func ProcessAll(program string, inputs []interface{}) ([][]interface{}, error) {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	results := make([][]interface{}, len(inputs))
+	for i, input := range inputs {
+		jq.Handle(input)
+		outputs, err := jq.All()
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+		results[i] = outputs
+	}
+	return results, nil
+}
+
+// Result is one output of a batch run, tagged with where it came from.
+type Result struct {
+	// InputIndex is the index of the input that produced the output.
+	InputIndex int
+	// OutputIndex counts the outputs for that input, from zero.
+	OutputIndex int
+	Value       interface{}
+}
+
+// ProcessResults is like ProcessAll but returns the outputs for all of the
+// inputs in one slice, in order, each tagged with the input that produced
+// it and its position among that input's outputs.
+func ProcessResults(program string, inputs []interface{}) ([]Result, error) {
+	var results []Result
+	outputIndex := 0
+	err := Each(program, inputs, func(index int, output interface{}) error {
+		if len(results) == 0 || results[len(results)-1].InputIndex != index {
+			outputIndex = 0
+		}
+		results = append(results, Result{index, outputIndex, output})
+		outputIndex++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ProcessSorted runs program over each of inputs, as Each does, and returns
+// all of the outputs sorted by the jq expression key, as sort_by(key)
+// would sort them if they were all in one array. Outputs with equal keys
+// keep the order they were produced in.
+func ProcessSorted(program string, inputs []interface{}, key string) ([]interface{}, error) {
+	outputs := []interface{}{}
+	err := Each(program, inputs, func(_ int, output interface{}) error {
+		outputs = append(outputs, output)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sorted, err := runSingle("sort_by("+key+")", outputs)
+	if err != nil {
+		return nil, err
+	}
+	return sorted.([]interface{}), nil
+}
+
+// Reduce runs program once over all of inputs gathered into one array, as
+// jq --slurp does, and returns its single output. It suits aggregations
+// such as add, `reduce .[] as $r ({}; . * $r)` or `map(.n) | add`. It is an
+// error for the program to produce no outputs or more than one.
+func Reduce(program string, inputs []interface{}) (interface{}, error) {
+	if inputs == nil {
+		inputs = []interface{}{}
+	}
+	return runSingle(program, inputs)
+}
+
+// Each compiles program once and calls fn with every output for each of
+// inputs in turn, along with the index of the input that produced it. It
+// stops at the first error, returning errors from fn unchanged.
+func Each(program string, inputs []interface{}, fn func(index int, output interface{}) error) error {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return err
+	}
+	defer jq.Close()
+
+	for i, input := range inputs {
+		jq.Handle(input)
+		for jq.Next() {
+			if err := fn(i, jq.Value()); err != nil {
+				return err
+			}
+		}
+		if err := jq.Err(); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// EachKey calls fn with each key of the JSON object input, in the order of
+// the text, by running keys_unsorted[] over it. It stops at the first
+// error, returning errors from fn unchanged; input that is not an object
+// is an error.
+func EachKey(input string, fn func(key string) error) error {
+	return eachMember(`if type == "object" then keys_unsorted[] else error("Cannot iterate over keys of \(type)") end`, input, func(jq *JQ) error {
+		return fn(jvGoString(jq.lastValue))
+	})
+}
+
+// EachValue calls fn with each value of the JSON object input, in the
+// order of the text, by running .[] over it. Values are passed undecoded,
+// so large objects can be scanned without converting them to Go maps
+// first. v is freed when fn returns; decode what is needed with its
+// methods before then. It stops at the first error, returning errors from
+// fn unchanged; input that is not an object is an error.
+func EachValue(input string, fn func(v Value) error) error {
+	return eachMember(`if type == "object" then .[] else error("Cannot iterate over values of \(type)") end`, input, func(jq *JQ) error {
+		v := jq.ValueRef()
+		defer v.Free()
+		return fn(v)
+	})
+}
+
+func eachMember(program, input string, fn func(jq *JQ) error) error {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return err
+	}
+	defer jq.Close()
+
+	if err := jq.HandleJson(input); err != nil {
+		return err
+	}
+	for jq.Next() {
+		if err := fn(jq); err != nil {
+			return err
+		}
+	}
+	return jq.Err()
+}
+
+// RunWith compiles program with each of args bound to a $name variable, as
+// WithArg does, runs it over input and returns all of its outputs. As with
+// All, outputs produced before an error are returned along with it.
+func RunWith(program string, input interface{}, args map[string]interface{}) ([]interface{}, error) {
+	opts := make([]Option, 0, len(args))
+	for name, value := range args {
+		opts = append(opts, WithArg(name, value))
+	}
+	jq, err := NewJQ(program, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	jq.Handle(input)
+	return jq.All()
+}
+
+// RunJSON compiles program, runs it over the JSON text input and returns
+// the compact JSON encoding of each output. Nothing is converted to or from
+// Go values on the way, so keys keep their order and numbers are printed
+// by libjq, which from jq 1.7 passes untouched number literals through as
+// written. As with All, outputs produced before an error are returned along
+// with it.
+//
+// The input must be exactly one JSON value, which may be of any kind: a
+// bare number, string, boolean or null is run on just as an array or
+// object is. Empty input, or more than one value, is an error; use
+// StreamJSON for a sequence of values.
+func RunJSON(program, input string) ([]string, error) {
+	return RunJSONCtx(context.Background(), program, input)
+}
+
+// RunJSONCtx is RunJSON with a context. If ctx is done before the program
+// finishes, the outputs stop and ctx's error is returned with those
+// produced so far. Like Cancel, this takes effect between outputs.
+func RunJSONCtx(ctx context.Context, program, input string) ([]string, error) {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	if err := jq.HandleJson(input); err != nil {
+		return nil, err
+	}
+	stop := jq.cancelWhenDone(ctx)
+	defer stop()
+	var outputs []string
+	for jq.Next() {
+		outputs = append(outputs, jq.ValueJson())
+	}
+	return outputs, contextError(ctx, jq.Err())
+}
+
+// Transform is like RunJSON, and accepts the same inputs, but takes and
+// returns bytes, with each output followed by a newline as WriteAll writes
+// them.
+func Transform(program string, input []byte) ([]byte, error) {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	if err := jq.HandleJsonBytes(input); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = jq.WriteAll(&out)
+	return out.Bytes(), err
+}
+
+// Run compiles program, runs it over input and decodes every output into a
+// T, as ValueInto does.
+func Run[T any](program string, input interface{}) ([]T, error) {
+	return RunCtx[T](context.Background(), program, input)
+}
+
+// RunCtx is Run with a context. If ctx is done before the program finishes,
+// the outputs stop and ctx's error is returned. Like Cancel, this takes
+// effect between outputs, so a program that loops without producing any is
+// not interrupted.
+func RunCtx[T any](ctx context.Context, program string, input interface{}) ([]T, error) {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	jq.Handle(input)
+	stop := jq.cancelWhenDone(ctx)
+	defer stop()
+	var results []T
+	err = ForEach(jq, func(v T) error {
+		results = append(results, v)
+		return nil
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return results, nil
+}
+
+// cancelWhenDone calls Cancel once ctx is done, until stop is called. It
+// must be called after Handle, which clears any earlier Cancel.
+func (jq *JQ) cancelWhenDone(ctx context.Context) (stop func()) {
+	if ctx.Err() != nil {
+		jq.Cancel()
+		return func() {}
+	}
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			jq.Cancel()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// contextError returns err, or ctx's error in its place if the outputs were
+// cancelled because of it.
+func contextError(ctx context.Context, err error) error {
+	if err == ErrCancelled && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Builtins returns the functions built into the linked jq, sorted, as
+// name/arity pairs such as "map/1", using jq's builtins.
+func Builtins() ([]string, error) {
+	names, err := Run[string]("builtins[]", nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GetPath returns the value at path in input, as jq's getpath does. Path
+// elements are object keys (strings) or array indexes (numbers).
+func GetPath(input interface{}, path []interface{}) (interface{}, error) {
+	return runSingle("getpath($p)", input, WithArg("p", path))
+}
+
+// SetPath returns input with the value at path replaced by value, as jq's
+// setpath does, creating any missing objects and arrays along the way.
+func SetPath(input interface{}, path []interface{}, value interface{}) (interface{}, error) {
+	return runSingle("setpath($p; $v)", input, WithArg("p", path), WithArg("v", value))
+}
+
+// diffProgram lists the differences between $a and $b, see Diff.
+const diffProgram = `
+def diff($a; $b; $path):
+  if $a == $b then empty
+  elif ($a | type) == "object" and ($b | type) == "object" then
+    (($a | keys[]) as $k
+      | if $b | has($k) then diff($a[$k]; $b[$k]; $path + [$k])
+        else {op: "remove", path: ($path + [$k]), from: $a[$k]} end),
+    ((($b | keys) - ($a | keys))[] as $k
+      | {op: "add", path: ($path + [$k]), to: $b[$k]})
+  elif ($a | type) == "array" and ($b | type) == "array" then
+    (range([$a, $b | length] | min) as $i | diff($a[$i]; $b[$i]; $path + [$i])),
+    (range($b | length; $a | length) as $i | {op: "remove", path: ($path + [$i]), from: $a[$i]}),
+    (range($a | length; $b | length) as $i | {op: "add", path: ($path + [$i]), to: $b[$i]})
+  else {op: "change", path: $path, from: $a, to: $b}
+  end;
+[diff($a; $b; [])]`
+
+// Diff compares a and b structurally and returns the differences as an
+// array of objects, each with an "op" and the "path" it applies to:
+//
+//	{"op": "add", "path": [...], "to": value}       only in b
+//	{"op": "remove", "path": [...], "from": value}  only in a
+//	{"op": "change", "path": [...], "from": x, "to": y}
+//
+// Objects are compared key by key and arrays element by element, so an
+// element inserted into the middle of an array shows up as changes to
+// every element after it. Equal values give an empty array. Differences
+// come in path order, with object keys sorted, except that keys only in b
+// follow the rest of their object's.
+func Diff(a, b interface{}) (interface{}, error) {
+	return runSingle(diffProgram, nil, WithArg("a", a), WithArg("b", b))
+}
+
+// PathFilter returns a jq program that gets the value at the given object
+// keys, e.g. .a["b.c"] for the segments "a" and "b.c". Keys that are not
+// plain identifiers are quoted, so any string is safe to use, including
+// ones containing quotes, brackets, dots or string interpolation. No
+// segments gives the identity filter.
+func PathFilter(segments []string) string {
+	path := ""
+	for _, segment := range segments {
+		path = joinPath(path, pathKey(segment))
+	}
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+// runSingle runs a program known to produce one output for each input.
+func runSingle(program string, input interface{}, opts ...Option) (interface{}, error) {
+	jq, err := NewJQ(program, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer jq.Close()
+
+	jq.Handle(input)
+	return jq.Single()
+}
@@ -0,0 +1,394 @@
+package jq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessLines(t *testing.T) {
+	results, err := ProcessLines("length", strings.NewReader("a\nbb\n\nccc"))
+	ok(t, err)
+	equals(t, []interface{}{1, 2, 0, 3}, results)
+}
+
+func TestProcessLinesTrailingNewline(t *testing.T) {
+	results, err := ProcessLines(".", strings.NewReader("one\ntwo\n"))
+	ok(t, err)
+	equals(t, []interface{}{"one", "two"}, results)
+}
+
+func TestProcessLinesLongLine(t *testing.T) {
+	line := strings.Repeat("x", 1<<20)
+	results, err := ProcessLines("length", strings.NewReader(line+"\n"+line))
+	ok(t, err)
+	equals(t, []interface{}{1 << 20, 1 << 20}, results)
+}
+
+func TestProcessLinesEmpty(t *testing.T) {
+	results, err := ProcessLines(".", strings.NewReader(""))
+	ok(t, err)
+	equals(t, 0, len(results))
+}
+
+func TestProcessLinesError(t *testing.T) {
+	_, err := ProcessLines("fromjson", strings.NewReader("1\nnot json\n"))
+	assert(t, err != nil, "expected an error for invalid JSON line")
+}
+
+func TestProcessAll(t *testing.T) {
+	inputs := []interface{}{
+		[]int{1, 2},
+		[]int{},
+		map[string]int{"a": 3},
+	}
+	results, err := ProcessAll(".[]", inputs)
+	ok(t, err)
+	equals(t, [][]interface{}{{1, 2}, nil, {3}}, results)
+}
+
+func TestProcessAllError(t *testing.T) {
+	_, err := ProcessAll(".a", []interface{}{map[string]int{"a": 1}, 2})
+	assert(t, err != nil, "expected a runtime error")
+	assert(t, strings.HasPrefix(err.Error(), "input 1: "), "error should name the input: %s", err)
+}
+
+func TestEach(t *testing.T) {
+	type output struct {
+		index int
+		value interface{}
+	}
+	var got []output
+	err := Each(".[]", []interface{}{[]int{1, 2}, []int{}, []int{3}}, func(i int, v interface{}) error {
+		got = append(got, output{i, v})
+		return nil
+	})
+	ok(t, err)
+	equals(t, []output{{0, 1}, {0, 2}, {2, 3}}, got)
+}
+
+func TestEachKeyAndValue(t *testing.T) {
+	input := `{"b": {"n": 1}, "a": [2, 3], "c": null}`
+	var keys []string
+	ok(t, EachKey(input, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	equals(t, []string{"b", "a", "c"}, keys)
+
+	var kinds []string
+	ok(t, EachValue(input, func(v Value) error {
+		kinds = append(kinds, v.Kind())
+		return nil
+	}))
+	equals(t, []string{"object", "array", "null"}, kinds)
+
+	// fn's errors stop the iteration
+	stop := errors.New("stop")
+	calls := 0
+	err := EachValue(input, func(v Value) error {
+		calls++
+		if v.Kind() == "array" {
+			equals(t, 2, v.ArrayLen())
+			return stop
+		}
+		return nil
+	})
+	equals(t, stop, err)
+	equals(t, 2, calls)
+
+	err = EachKey(`[1]`, func(string) error { return nil })
+	equals(t, "Cannot iterate over keys of array", fmt.Sprint(err))
+	err = EachValue(`"s"`, func(Value) error { return nil })
+	equals(t, "Cannot iterate over values of string", fmt.Sprint(err))
+	assert(t, EachKey(`{`, func(string) error { return nil }) != nil, "expected a parse error")
+}
+
+func TestProcessResults(t *testing.T) {
+	results, err := ProcessResults(".[]", []interface{}{[]int{1, 2}, []int{}, []int{3}, []string{"a", "b"}})
+	ok(t, err)
+	equals(t, []Result{
+		{InputIndex: 0, OutputIndex: 0, Value: 1},
+		{InputIndex: 0, OutputIndex: 1, Value: 2},
+		{InputIndex: 2, OutputIndex: 0, Value: 3},
+		{InputIndex: 3, OutputIndex: 0, Value: "a"},
+		{InputIndex: 3, OutputIndex: 1, Value: "b"},
+	}, results)
+
+	_, err = ProcessResults(".a", []interface{}{map[string]int{"a": 1}, 2})
+	assert(t, err != nil && strings.HasPrefix(err.Error(), "input 1: "), "unexpected error: %v", err)
+}
+
+func TestProcessSorted(t *testing.T) {
+	inputs := []interface{}{
+		[]interface{}{map[string]interface{}{"n": "b", "v": 2}, map[string]interface{}{"n": "c", "v": 1}},
+		[]interface{}{},
+		[]interface{}{map[string]interface{}{"n": "a", "v": 2}},
+	}
+	sorted, err := ProcessSorted(".[]", inputs, ".v")
+	ok(t, err)
+	equals(t, []interface{}{
+		map[string]interface{}{"n": "c", "v": 1},
+		map[string]interface{}{"n": "b", "v": 2},
+		map[string]interface{}{"n": "a", "v": 2},
+	}, sorted)
+
+	sorted, err = ProcessSorted(".[]", inputs[1:2], ".v")
+	ok(t, err)
+	equals(t, []interface{}{}, sorted)
+
+	_, err = ProcessSorted(".[]", inputs, ".v[")
+	assert(t, err != nil, "expected a compile error")
+	_, err = ProcessSorted(".[]", []interface{}{1}, ".v")
+	assert(t, err != nil, "expected a runtime error")
+}
+
+func TestRunJSON(t *testing.T) {
+	outputs, err := RunJSON(".[]", `[{"z": 1, "a": 1.5}, 1e1000, "x", null]`)
+	ok(t, err)
+	equals(t, []string{`{"z":1,"a":1.5}`, `1.7976931348623157e+308`, `"x"`, `null`}, outputs)
+
+	outputs, err = RunJSON(".[] | .a", `[{"a": 1}, 2]`)
+	assert(t, err != nil, "expected a runtime error")
+	equals(t, []string{`1`}, outputs)
+
+	_, err = RunJSON(".", `{`)
+	assert(t, err != nil, "expected a parse error")
+}
+
+func TestRunJSONTopLevelKinds(t *testing.T) {
+	for _, tc := range []struct{ input, want string }{
+		{`42`, `["number",42]`},
+		{` -1.5 `, `["number",-1.5]`},
+		{`"s"`, `["string","s"]`},
+		{`true`, `["boolean",true]`},
+		{`null`, `["null",null]`},
+		{`[1, "a"]`, `["array",[1,"a"]]`},
+		{"\n{\"b\": 1, \"a\": [2]}\n", `["object",{"b":1,"a":[2]}]`},
+	} {
+		outputs, err := RunJSON("[type, .]", tc.input)
+		ok(t, err)
+		equals(t, []string{tc.want}, outputs)
+
+		out, err := Transform("[type, .]", []byte(tc.input))
+		ok(t, err)
+		equals(t, tc.want+"\n", string(out))
+	}
+
+	for _, tc := range []struct{ input, err string }{
+		{``, "Invalid JSON: Expected JSON value"},
+		{` `, "Invalid JSON: Expected JSON value"},
+		{`1 2`, "Invalid JSON: Unexpected extra JSON values"},
+		{`{} []`, "Invalid JSON: Unexpected extra JSON values"},
+		{`nul`, "Invalid JSON: Invalid literal at EOF at line 1, column 3"},
+	} {
+		_, err := RunJSON(".", tc.input)
+		equals(t, tc.err, fmt.Sprint(err))
+		_, err = Transform(".", []byte(tc.input))
+		equals(t, tc.err, fmt.Sprint(err))
+	}
+}
+
+func TestTransformBytes(t *testing.T) {
+	out, err := Transform(".items[] | {id, b: .a}", []byte(`{"items": [{"id": 2, "a": [true]}, {"id": 1}]}`))
+	ok(t, err)
+	equals(t, "{\"id\":2,\"b\":[true]}\n{\"id\":1,\"b\":null}\n", string(out))
+
+	out, err = Transform(".[] | .a", []byte(`[{"a": 1}, 2]`))
+	assert(t, err != nil, "expected a runtime error")
+	equals(t, "1\n", string(out))
+}
+
+func TestReduce(t *testing.T) {
+	records := []interface{}{
+		map[string]interface{}{"n": 1, "tags": map[string]int{"a": 1}},
+		map[string]interface{}{"n": 2, "tags": map[string]int{"b": 2}},
+	}
+	sum, err := Reduce("map(.n) | add", records)
+	ok(t, err)
+	equals(t, 3, sum)
+
+	merged, err := Reduce("reduce .[] as $r ({}; . * $r)", records)
+	ok(t, err)
+	equals(t, map[string]interface{}{"n": 2, "tags": map[string]interface{}{"a": 1, "b": 2}}, merged)
+
+	count, err := Reduce("length", nil)
+	ok(t, err)
+	equals(t, 0, count)
+
+	_, err = Reduce(".[]", records)
+	equals(t, "Expected one output, got more than one", fmt.Sprint(err))
+}
+
+func TestRunCtx(t *testing.T) {
+	values, err := RunCtx[int](context.Background(), ".[]", []int{1, 2})
+	ok(t, err)
+	equals(t, []int{1, 2}, values)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = RunCtx[int](ctx, "range(infinite)", nil)
+	equals(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	outputs, err := RunJSONCtx(ctx, "range(infinite)", "null")
+	equals(t, context.DeadlineExceeded, err)
+	assert(t, len(outputs) > 0, "expected the outputs before the deadline")
+
+	// errors other than cancellation come through unchanged
+	_, err = RunCtx[string](context.Background(), ".[]", []int{1})
+	assert(t, err != nil && err != ErrCancelled, "expected a decoding error, got %v", err)
+}
+
+func TestEachStops(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := Each(".[]", []interface{}{[]int{1, 2}, []int{3}}, func(i int, v interface{}) error {
+		calls++
+		return stop
+	})
+	equals(t, stop, err)
+	equals(t, 1, calls)
+
+	err = Each(".a", []interface{}{map[string]int{"a": 1}, 2}, func(i int, v interface{}) error {
+		return nil
+	})
+	assert(t, err != nil && strings.HasPrefix(err.Error(), "input 1: "), "unexpected error: %v", err)
+}
+
+func TestPathFilter(t *testing.T) {
+	equals(t, ".", PathFilter(nil))
+	equals(t, ".a.b_1", PathFilter([]string{"a", "b_1"}))
+	equals(t, `.a["b.c"]`, PathFilter([]string{"a", "b.c"}))
+	equals(t, `.["1"]`, PathFilter([]string{"1"}))
+
+	for _, key := range []string{
+		"", "a.b", `say "hi"`, `\`, `\(1+1)`, "[0]", `"] | env | .["`, "tab\there", "nul\x00", "emoji \U0001F600", "<&>",
+	} {
+		program := PathFilter([]string{"outer", key})
+		jq, err := NewJQ(program)
+		ok(t, err)
+		jq.Handle(map[string]interface{}{"outer": map[string]interface{}{key: "found"}})
+		equals(t, true, jq.Next())
+		equals(t, "found", jq.Value())
+		jq.Close()
+	}
+}
+
+func TestRunWith(t *testing.T) {
+	results, err := RunWith(`.[] | select(.age >= $min) | .name`, []map[string]interface{}{
+		{"name": "a", "age": 30},
+		{"name": "b", "age": 10},
+	}, map[string]interface{}{"min": 18})
+	ok(t, err)
+	equals(t, []interface{}{"a"}, results)
+
+	results, err = RunWith(`.`, 1, nil)
+	ok(t, err)
+	equals(t, []interface{}{1}, results)
+
+	_, err = RunWith(`$missing`, 1, map[string]interface{}{"other": 1})
+	assert(t, err != nil, "expected a compile error")
+
+	_, err = RunWith(`error($msg)`, 1, map[string]interface{}{"msg": "bad"})
+	equals(t, "bad", fmt.Sprint(err))
+}
+
+func TestRunTyped(t *testing.T) {
+	type user struct {
+		Name  string `json:"name"`
+		Admin bool   `json:"admin"`
+	}
+	users, err := Run[user](`.users[] | select(.active) | {name, admin}`, map[string]interface{}{
+		"users": []map[string]interface{}{
+			{"name": "a", "admin": true, "active": true},
+			{"name": "b", "active": false},
+			{"name": "c", "active": true},
+		},
+	})
+	ok(t, err)
+	equals(t, []user{{"a", true}, {"c", false}}, users)
+
+	names, err := Run[string](`.[]`, []string{"x", "y"})
+	ok(t, err)
+	equals(t, []string{"x", "y"}, names)
+
+	_, err = Run[int](`.[]`, []interface{}{1, "two"})
+	assert(t, err != nil, "expected a decoding error")
+
+	_, err = Run[int](`.[`, nil)
+	assert(t, err != nil, "expected a compile error")
+}
+
+func TestDiff(t *testing.T) {
+	a := map[string]interface{}{"x": 1, "y": []int{1, 2, 3}, "z": map[string]bool{"k": true}, "same": "s"}
+	b := map[string]interface{}{"x": 2, "y": []int{1, 5}, "z": map[string]bool{}, "new": nil, "same": "s"}
+	expected := []interface{}{
+		map[string]interface{}{"op": "change", "path": []interface{}{"x"}, "from": 1, "to": 2},
+		map[string]interface{}{"op": "change", "path": []interface{}{"y", 1}, "from": 2, "to": 5},
+		map[string]interface{}{"op": "remove", "path": []interface{}{"y", 2}, "from": 3},
+		map[string]interface{}{"op": "remove", "path": []interface{}{"z", "k"}, "from": true},
+		map[string]interface{}{"op": "add", "path": []interface{}{"new"}, "to": nil},
+	}
+	// the order does not depend on how Go happens to order the maps
+	for i := 0; i < 5; i++ {
+		changes, err := Diff(a, b)
+		ok(t, err)
+		equals(t, expected, changes)
+	}
+
+	changes, err := Diff([]int{1}, []int{1})
+	ok(t, err)
+	equals(t, []interface{}{}, changes)
+
+	changes, err = Diff([]int{1}, map[string]int{"a": 1})
+	ok(t, err)
+	equals(t, []interface{}{
+		map[string]interface{}{"op": "change", "path": []interface{}{}, "from": []interface{}{1}, "to": map[string]interface{}{"a": 1}},
+	}, changes)
+}
+
+func TestBuiltins(t *testing.T) {
+	names, err := Builtins()
+	ok(t, err)
+	assert(t, sort.StringsAreSorted(names), "expected sorted names")
+	for _, name := range []string{"map/1", "select/1", "length/0", "builtins/0"} {
+		i := sort.SearchStrings(names, name)
+		assert(t, i < len(names) && names[i] == name, "missing %s in %v", name, names)
+	}
+}
+
+func TestGetPath(t *testing.T) {
+	input := map[string]interface{}{
+		"a": []interface{}{1, map[string]interface{}{"b.c": "x"}},
+	}
+	value, err := GetPath(input, []interface{}{"a", 1, "b.c"})
+	ok(t, err)
+	equals(t, "x", value)
+
+	value, err = GetPath(input, []interface{}{"missing", "deeper"})
+	ok(t, err)
+	equals(t, nil, value)
+
+	_, err = GetPath(input, []interface{}{"a", "b"})
+	assert(t, err != nil, "expected an error indexing an array with a string")
+}
+
+func TestSetPath(t *testing.T) {
+	input := map[string]interface{}{"a": []interface{}{1, 2}}
+	value, err := SetPath(input, []interface{}{"a", 0}, "one")
+	ok(t, err)
+	equals(t, map[string]interface{}{"a": []interface{}{"one", 2}}, value)
+
+	value, err = SetPath(nil, []interface{}{"x", 1}, true)
+	ok(t, err)
+	equals(t, map[string]interface{}{"x": []interface{}{nil, true}}, value)
+
+	// the input is not modified
+	equals(t, map[string]interface{}{"a": []interface{}{1, 2}}, input)
+}
@@ -0,0 +1,68 @@
+package jq
+
+// #cgo LDFLAGS: -ldl
+// #include <dlfcn.h>
+// #include <jq.h>
+// #include <stdint.h>
+//
+// extern void goJqStderrCallback(void *, jv);
+//
+// typedef void (*set_cb_fn)(jq_state *, jq_msg_cb, void *);
+//
+// // set_stderr_cb calls jq_set_stderr_cb if the linked jq has it. It is
+// // looked up at run time because jq 1.6 does not, and naming it directly
+// // would stop the package linking against it.
+// static int set_stderr_cb(jq_state *jq, uintptr_t handle) {
+//   set_cb_fn set = (set_cb_fn)dlsym(RTLD_DEFAULT, "jq_set_stderr_cb");
+//   if (set == NULL) {
+//     return 0;
+//   }
+//   set(jq, goJqStderrCallback, (void *)handle);
+//   return 1;
+// }
+import "C"
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// SetStderrHandler passes what the program's stderr builtin writes to
+// handler instead of the process's standard error: strings as they are,
+// other values as compact JSON. A nil handler writes them to os.Stderr
+// again.
+//
+// It needs jq 1.7 or later and returns an error wrapping ErrUnsupported
+// otherwise. jq 1.6 writes stderr's input straight to the C library's
+// standard error, with no callback through which it could be captured,
+// which is also why stderr is in UntrustedDenylist.
+func (jq *JQ) SetStderrHandler(handler func(raw string)) error {
+	if err := featureStderr.check(); err != nil {
+		return err
+	}
+	if !jq.stderrHooked {
+		if C.set_stderr_cb(jq.state, C.uintptr_t(jq.handle)) == 0 {
+			return fmt.Errorf("%w: linked jq has no jq_set_stderr_cb", ErrUnsupported)
+		}
+		jq.stderrHooked = true
+	}
+	jq.stderrHandler = handler
+	return nil
+}
+
+//export goJqStderrCallback
+func goJqStderrCallback(data unsafe.Pointer, msg C.jv) {
+	jq := handleJQ(data)
+	var raw string
+	if C.jv_get_kind(msg) == C.JV_KIND_STRING {
+		raw = jvGoString(msg)
+	} else {
+		raw = dumpJson(msg)
+	}
+	freeJv(msg)
+	if jq.stderrHandler == nil {
+		os.Stderr.WriteString(raw)
+		return
+	}
+	jq.stderrHandler(raw)
+}
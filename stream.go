@@ -0,0 +1,274 @@
+package jq
+
+// #include <jv.h>
+// #include <stdlib.h>
+import "C"
+import (
+	"bufio"
+	"errors"
+	"io"
+	"unsafe"
+)
+
+const streamBufferSize = 64 * 1024
+
+// jsonStream incrementally parses a sequence of JSON values from a reader
+// using jq's own parser, so each value goes straight to a jv.
+type jsonStream struct {
+	reader io.Reader
+	parser *C.struct_jv_parser
+	buf    []byte
+	cbuf   unsafe.Pointer // jq's parser keeps a pointer to the current chunk
+	eof    bool
+}
+
+// newJsonStream parses values from r. Passing C.JV_PARSE_STREAMING as flags
+// yields the events of jq's --stream form instead of whole values.
+func newJsonStream(r io.Reader, flags C.int) *jsonStream {
+	return &jsonStream{
+		reader: r,
+		parser: C.jv_parser_new(flags),
+		buf:    make([]byte, streamBufferSize),
+	}
+}
+
+// next returns the next value in the stream, which the caller owns, or
+// io.EOF once the input is exhausted.
+func (s *jsonStream) next() (C.jv, error) {
+	for {
+		v := trackJv(C.jv_parser_next(s.parser))
+		if isValid(v) {
+			return v, nil
+		}
+		if err := invalidError(v); err != nil {
+			freeJv(v)
+			return C.jv_invalid(), err
+		}
+		freeJv(v)
+		if s.eof {
+			return C.jv_invalid(), io.EOF
+		}
+		if err := s.fill(); err != nil {
+			return C.jv_invalid(), err
+		}
+	}
+}
+
+func (s *jsonStream) fill() error {
+	n, err := s.reader.Read(s.buf)
+	if err == io.EOF {
+		s.eof = true
+	} else if err != nil {
+		return err
+	}
+	if n == 0 && !s.eof {
+		return nil
+	}
+
+	s.freeBuffer()
+	s.cbuf = C.CBytes(s.buf[:n])
+	partial := C.int(1)
+	if s.eof {
+		partial = 0
+	}
+	C.jv_parser_set_buf(s.parser, (*C.char)(s.cbuf), C.int(n), partial)
+	return nil
+}
+
+func (s *jsonStream) freeBuffer() {
+	if s.cbuf != nil {
+		C.free(s.cbuf)
+		s.cbuf = nil
+	}
+}
+
+func (s *jsonStream) close() {
+	C.jv_parser_free(s.parser)
+	s.freeBuffer()
+}
+
+// StreamJSON compiles program, runs it on each JSON value read from in and
+// writes the outputs to out as newline-delimited JSON, the equivalent of
+// `jq -c program < in > out`. The input and inputs builtins read ahead from
+// in, taking values that would otherwise be the next inputs. Output is
+// buffered, and flushed whenever more input is needed and at the end; if
+// out has a Flush method it is called then too, so results reach HTTP
+// clients and the like promptly.
+func StreamJSON(program string, in io.Reader, out io.Writer) error {
+	return streamJSON(program, in, out, 0)
+}
+
+// StreamJSONEvents is StreamJSON with the input in jq's streamed form, the
+// equivalent of `jq -c --stream program < in > out`, so documents too large
+// to hold in memory can be processed. The program runs with each event as
+// its input, and as with the command line tool input and inputs read the
+// events that follow, e.g. to rebuild top level array elements one by one:
+//
+//	. as $first | fromstream(1|truncate_stream($first, inputs))
+func StreamJSONEvents(program string, in io.Reader, out io.Writer) error {
+	return streamJSON(program, in, out, C.JV_PARSE_STREAMING)
+}
+
+// StreamEvents calls fn with each event of the streamed form of the JSON
+// values read from in, as jq --stream produces them: [path, leaf] for every
+// scalar or empty container, and [path] closing each array or object, with
+// path the array of keys and indexes leading to it. It stops at the first
+// error, returning errors from fn unchanged.
+func StreamEvents(in io.Reader, fn func(event []interface{}) error) error {
+	input := newJsonStream(in, C.JV_PARSE_STREAMING)
+	defer input.close()
+
+	for {
+		v, err := input.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		event, _ := jvToGo(v).([]interface{})
+		freeJv(v)
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+}
+
+func streamJSON(program string, in io.Reader, out io.Writer, flags C.int) error {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return err
+	}
+	defer jq.Close()
+
+	w := &flushingWriter{bufio.NewWriter(out), out}
+	input := newJsonStream(&flushBeforeRead{in, w}, flags)
+	// let input and inputs read ahead, as the command line tool does; Close
+	// releases the stream
+	jq.inputs = input
+
+	for {
+		v, err := input.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.flush()
+			return err
+		}
+		jq.start(v)
+		if err := jq.WriteAll(w); err != nil {
+			w.flush()
+			return err
+		}
+	}
+	return w.flush()
+}
+
+type flushingWriter struct {
+	*bufio.Writer
+	dest io.Writer
+}
+
+func (w *flushingWriter) flush() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return flush(w.dest)
+}
+
+// flush calls w's Flush method, if it has one.
+func flush(w io.Writer) error {
+	switch f := w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
+// flushBeforeRead flushes pending output before reading input that may block.
+type flushBeforeRead struct {
+	reader io.Reader
+	writer *flushingWriter
+}
+
+func (r *flushBeforeRead) Read(p []byte) (int, error) {
+	if err := r.writer.flush(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// TransformStream compiles program and returns a reader that lazily pulls
+// JSON values from in, runs the filter on each, and yields the outputs as
+// newline-delimited JSON. Parse and runtime errors are returned from Read.
+//
+// The jq state is released when the stream ends or fails; callers that stop
+// reading early should Close the returned reader.
+func TransformStream(program string, in io.Reader) (io.ReadCloser, error) {
+	jq, err := NewJQ(program)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonReader{jq: jq, input: newJsonStream(in, 0)}, nil
+}
+
+type ndjsonReader struct {
+	jq      *JQ
+	input   *jsonStream
+	pending []byte
+	err     error
+}
+
+func (r *ndjsonReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.advance()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// advance fills pending with the next output, or sets err at the end of the
+// stream.
+func (r *ndjsonReader) advance() {
+	if r.jq.Next() {
+		r.pending = r.jq.AppendValueJson(r.pending[:0])
+		r.pending = append(r.pending, '\n')
+		return
+	}
+	if err := r.jq.Err(); err != nil {
+		r.fail(err)
+		return
+	}
+	v, err := r.input.next()
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	r.jq.start(v)
+}
+
+func (r *ndjsonReader) fail(err error) {
+	r.err = err
+	r.Close()
+}
+
+func (r *ndjsonReader) Close() error {
+	if r.jq != nil {
+		r.jq.Close()
+		r.input.close()
+		r.jq = nil
+	}
+	if r.err == nil {
+		r.err = errClosed
+	}
+	return nil
+}
+
+var errClosed = errors.New("jq: read from closed stream")
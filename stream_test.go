@@ -0,0 +1,193 @@
+package jq
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTransformStream(t *testing.T) {
+	in := strings.NewReader(`{"a": 1} {"a": [2, 3]}` + "\n" + `{"a": "four"}`)
+	r, err := TransformStream(".a", in)
+	ok(t, err)
+	defer r.Close()
+
+	out, err := io.ReadAll(r)
+	ok(t, err)
+	equals(t, "1\n[2,3]\n\"four\"\n", string(out))
+}
+
+func TestTransformStreamMultipleOutputs(t *testing.T) {
+	r, err := TransformStream(".[]", strings.NewReader("[1, 2] [] [3]"))
+	ok(t, err)
+	defer r.Close()
+
+	out, err := io.ReadAll(r)
+	ok(t, err)
+	equals(t, "1\n2\n3\n", string(out))
+}
+
+func TestTransformStreamSmallReads(t *testing.T) {
+	in := iotest.OneByteReader(strings.NewReader(`{"word": "hello"} 42 "x"`))
+	r, err := TransformStream(".", in)
+	ok(t, err)
+	defer r.Close()
+
+	out, err := io.ReadAll(iotest.OneByteReader(r))
+	ok(t, err)
+	equals(t, "{\"word\":\"hello\"}\n42\n\"x\"\n", string(out))
+}
+
+func TestTransformStreamRuntimeError(t *testing.T) {
+	r, err := TransformStream(".a", strings.NewReader(`{"a": 1} 2 {"a": 3}`))
+	ok(t, err)
+	defer r.Close()
+
+	out, err := io.ReadAll(r)
+	assert(t, err != nil, "expected a runtime error")
+	equals(t, "1\n", string(out))
+}
+
+func TestTransformStreamParseError(t *testing.T) {
+	r, err := TransformStream(".", strings.NewReader(`1 {"a": }`))
+	ok(t, err)
+	defer r.Close()
+
+	out, err := io.ReadAll(r)
+	assert(t, err != nil, "expected a parse error")
+	equals(t, "1\n", string(out))
+}
+
+func TestTransformStreamClose(t *testing.T) {
+	r, err := TransformStream(".", strings.NewReader("1 2 3"))
+	ok(t, err)
+
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(r, buf)
+	ok(t, err)
+	equals(t, "1\n", string(buf))
+
+	ok(t, r.Close())
+	_, err = r.Read(buf)
+	equals(t, errClosed, err)
+}
+
+func TestTransformStreamCompileError(t *testing.T) {
+	_, err := TransformStream(".a[", strings.NewReader(""))
+	assert(t, err != nil, "expected a compile error")
+}
+
+func TestStreamJSON(t *testing.T) {
+	var out bytes.Buffer
+	err := StreamJSON(".[]", strings.NewReader("[1, 2]\n[{\"a\": [3]}] []"), &out)
+	ok(t, err)
+	equals(t, "1\n2\n{\"a\":[3]}\n", out.String())
+}
+
+func TestStreamJSONRuntimeError(t *testing.T) {
+	var out bytes.Buffer
+	err := StreamJSON(".a", strings.NewReader(`{"a": 1} 2`), &out)
+	assert(t, err != nil, "expected a runtime error")
+	equals(t, "1\n", out.String())
+}
+
+func TestStreamJSONParseError(t *testing.T) {
+	var out bytes.Buffer
+	err := StreamJSON(".", strings.NewReader(`1 ]`), &out)
+	assert(t, err != nil, "expected a parse error")
+	equals(t, "1\n", out.String())
+}
+
+// chunkReader returns one chunk per Read, recording what had been written to
+// out by the time of each read.
+type chunkReader struct {
+	chunks []string
+	out    *bytes.Buffer
+	seen   []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	r.seen = append(r.seen, r.out.String())
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+}
+
+func TestStreamJSONFlushesBeforeReading(t *testing.T) {
+	out := &flushCounter{}
+	in := &chunkReader{chunks: []string{"1 ", "2 ", "3"}, out: &out.Buffer}
+	ok(t, StreamJSON(".", in, out))
+
+	equals(t, []string{"", "1\n", "1\n2\n", "1\n2\n"}, in.seen)
+	equals(t, "1\n2\n3\n", out.String())
+	equals(t, 5, out.flushes)
+}
+
+func TestStreamEvents(t *testing.T) {
+	var events [][]interface{}
+	err := StreamEvents(iotest.OneByteReader(strings.NewReader(`{"a": [1, {"b": null}], "c": []} 2`)), func(event []interface{}) error {
+		events = append(events, event)
+		return nil
+	})
+	ok(t, err)
+	equals(t, [][]interface{}{
+		{[]interface{}{"a", 0}, 1},
+		{[]interface{}{"a", 1, "b"}, nil},
+		{[]interface{}{"a", 1, "b"}},
+		{[]interface{}{"a", 1}},
+		{[]interface{}{"c"}, []interface{}{}},
+		{[]interface{}{"c"}},
+		{[]interface{}{}, 2},
+	}, events)
+}
+
+func TestStreamEventsStops(t *testing.T) {
+	stop := io.ErrShortWrite
+	calls := 0
+	err := StreamEvents(strings.NewReader(`[1, 2, 3]`), func(event []interface{}) error {
+		calls++
+		return stop
+	})
+	equals(t, stop, err)
+	equals(t, 1, calls)
+
+	err = StreamEvents(strings.NewReader(`[1, 2`), func(event []interface{}) error { return nil })
+	assert(t, err != nil, "expected a parse error")
+}
+
+func TestStreamJSONEvents(t *testing.T) {
+	var out bytes.Buffer
+	err := StreamJSONEvents(`. as $first | fromstream(1|truncate_stream($first, inputs))`, strings.NewReader(`[{"id": 1}, {"id": 2}]`), &out)
+	ok(t, err)
+	equals(t, "{\"id\":1}\n{\"id\":2}\n", out.String())
+
+	out.Reset()
+	err = StreamJSONEvents(`select(length == 2) | .[0] | join(".")`, strings.NewReader(`{"a": {"b": 1}}`), &out)
+	ok(t, err)
+	equals(t, "\"a.b\"\n", out.String())
+}
+
+func TestStreamJSONInputs(t *testing.T) {
+	var out bytes.Buffer
+	err := StreamJSON(`[., input]`, strings.NewReader(`1 2 3 4`), &out)
+	ok(t, err)
+	equals(t, "[1,2]\n[3,4]\n", out.String())
+
+	out.Reset()
+	err = StreamJSON(`[., input]`, strings.NewReader(`1`), &out)
+	assert(t, err != nil, "expected an error reading past the last input")
+}
@@ -0,0 +1,143 @@
+package jq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DuplicateKeyError reports an object in the input that repeats a key. jq's
+// parser silently keeps the last value, so these are found by a separate
+// scan of the text.
+type DuplicateKeyError struct {
+	Path string // jq path of the object, e.g. .items[2]
+	Key  string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "."
+	}
+	return fmt.Sprintf("duplicate key %q in object at %s", e.Key, path)
+}
+
+// SetRejectDuplicateKeys makes HandleJson and HandleJsonBytes fail with a
+// *DuplicateKeyError when the input contains an object with a repeated key,
+// instead of keeping the last value as jq does. It costs an extra pass over
+// the text.
+func (jq *JQ) SetRejectDuplicateKeys(reject bool) {
+	jq.rejectDuplicateKeys = reject
+}
+
+// DuplicateKeys scans JSON text and returns every repeated object key it
+// contains, in document order.
+func DuplicateKeys(text string) ([]*DuplicateKeyError, error) {
+	return scanDuplicateKeys(strings.NewReader(text), false)
+}
+
+func scanDuplicateKeys(text io.Reader, firstOnly bool) ([]*DuplicateKeyError, error) {
+	type level struct {
+		object    bool
+		expectKey bool
+		keys      map[string]bool
+		key       string // key of the value being read
+		index     int    // index of the next array element
+		path      string
+	}
+
+	dec := json.NewDecoder(text)
+	dec.UseNumber()
+
+	var found []*DuplicateKeyError
+	var stack []*level
+	top := func() *level {
+		if len(stack) == 0 {
+			return nil
+		}
+		return stack[len(stack)-1]
+	}
+	// childPath returns the path of the value about to be read, advancing
+	// the array index if the value is an element.
+	childPath := func() string {
+		parent := top()
+		if parent == nil {
+			return ""
+		}
+		if parent.object {
+			return joinPath(parent.path, pathKey(parent.key))
+		}
+		parent.index++
+		return joinPath(parent.path, "["+strconv.Itoa(parent.index-1)+"]")
+	}
+	valueDone := func() {
+		if parent := top(); parent != nil && parent.object {
+			parent.expectKey = true
+		}
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return found, err
+		}
+
+		if current := top(); current != nil && current.expectKey {
+			if tok == json.Delim('}') {
+				stack = stack[:len(stack)-1]
+				valueDone()
+				continue
+			}
+			key := tok.(string)
+			if current.keys[key] {
+				found = append(found, &DuplicateKeyError{Path: current.path, Key: key})
+				if firstOnly {
+					return found, nil
+				}
+			}
+			current.keys[key] = true
+			current.key = key
+			current.expectKey = false
+			continue
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			stack = append(stack, &level{object: true, expectKey: true, keys: map[string]bool{}, path: childPath()})
+		case json.Delim('['):
+			stack = append(stack, &level{path: childPath()})
+		case json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			childPath()
+			valueDone()
+		}
+	}
+}
+
+var identifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*$`)
+
+// pathKey formats an object key as a jq path component.
+func pathKey(key string) string {
+	if identifier.MatchString(key) {
+		return "." + key
+	}
+	quoted, _ := json.Marshal(key)
+	return "[" + string(quoted) + "]"
+}
+
+// joinPath appends a component to a jq path; a bracketed component needs a
+// leading dot when it starts the path.
+func joinPath(path, component string) string {
+	if path == "" && strings.HasPrefix(component, "[") {
+		return "." + component
+	}
+	return path + component
+}
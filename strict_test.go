@@ -0,0 +1,54 @@
+package jq
+
+import "testing"
+
+func TestDuplicateKeys(t *testing.T) {
+	dups, err := DuplicateKeys(`{"a": 1, "b": {"c": [1, {"d": 1, "d": 2}], "c": 3}, "a": 4, "x y": {"z": 1, "z": 2}}`)
+	ok(t, err)
+	equals(t, []*DuplicateKeyError{
+		{Path: ".b.c[1]", Key: "d"},
+		{Path: ".b", Key: "c"},
+		{Path: "", Key: "a"},
+		{Path: `.["x y"]`, Key: "z"},
+	}, dups)
+}
+
+func TestDuplicateKeysNone(t *testing.T) {
+	dups, err := DuplicateKeys(`[{"a": "a"}, {"a": ["a", "a"]}, "a"]`)
+	ok(t, err)
+	equals(t, 0, len(dups))
+}
+
+func TestDuplicateKeysRootArray(t *testing.T) {
+	dups, err := DuplicateKeys(`[1, {"k": 1, "k": 1}]`)
+	ok(t, err)
+	equals(t, []*DuplicateKeyError{{Path: ".[1]", Key: "k"}}, dups)
+}
+
+func TestDuplicateKeysInvalid(t *testing.T) {
+	_, err := DuplicateKeys(`{"a": }`)
+	assert(t, err != nil, "expected a syntax error")
+}
+
+func TestDuplicateKeyErrorMessage(t *testing.T) {
+	equals(t, `duplicate key "a" in object at .`, (&DuplicateKeyError{Key: "a"}).Error())
+	equals(t, `duplicate key "b" in object at .x`, (&DuplicateKeyError{Path: ".x", Key: "b"}).Error())
+}
+
+func TestRejectDuplicateKeys(t *testing.T) {
+	jq, err := NewJQ(".a")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleJson(`{"a": 1, "a": 2}`))
+	equals(t, true, jq.Next())
+	equals(t, 2, jq.Value())
+
+	jq.SetRejectDuplicateKeys(true)
+	err = jq.HandleJson(`{"a": 1, "a": 2}`)
+	equals(t, &DuplicateKeyError{Key: "a"}, err)
+
+	ok(t, jq.HandleJson(`{"a": 1}`))
+	equals(t, true, jq.Next())
+	equals(t, 1, jq.Value())
+}
@@ -0,0 +1,58 @@
+package jq
+
+// #include <stdlib.h>
+// #include <time.h>
+import "C"
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithTimezone runs the program with the time zone set to name, an IANA
+// zone such as "Europe/London" or "UTC", so that localtime, strflocaltime
+// and the other builtins that work in local time give the same answers
+// whatever the host's zone. The other date builtins work in UTC and are
+// unaffected.
+//
+// libjq reads the zone from the process-wide TZ variable, so this sets TZ
+// around each step of the program and restores it afterwards. Instances
+// with a zone take turns through a global lock, but anything else in the
+// process that uses the C library's local time while one of them is
+// running, including other instances without a zone, sees the pinned zone
+// for that moment. Go's time package is not affected. The zone must be
+// known both to Go, which checks the name, and to the C library, which
+// silently falls back to UTC for zones it cannot find.
+func WithTimezone(name string) Option {
+	return func(jq *JQ) error {
+		if name == "" || name == "Local" {
+			return errors.New("Time zone must be named")
+		}
+		if _, err := time.LoadLocation(name); err != nil {
+			return err
+		}
+		jq.timezone = name
+		return nil
+	}
+}
+
+var timezoneLock sync.Mutex
+
+// useTimezone points the C library at the zone name until restore is
+// called.
+func useTimezone(name string) (restore func()) {
+	timezoneLock.Lock()
+	old, had := os.LookupEnv("TZ")
+	os.Setenv("TZ", name)
+	C.tzset()
+	return func() {
+		if had {
+			os.Setenv("TZ", old)
+		} else {
+			os.Unsetenv("TZ")
+		}
+		C.tzset()
+		timezoneLock.Unlock()
+	}
+}
@@ -0,0 +1,465 @@
+package jq
+
+// UsesInput reports whether the program may read its input, either as . or
+// through the input and inputs builtins. When it returns false the program
+// is a generator like `range(5)` or `[limit(3; range(10))]`, and can be run
+// with Handle(nil) the way jq -n runs it.
+//
+// The answer comes from scanning the program text rather than from jq, so
+// it is conservative: it returns true whenever it cannot rule out a read.
+// In particular any call to a builtin other than a handful of generators
+// such as range, limit and error counts as reading the input, as does .
+// inside a function body or after catch, even where it only sees the
+// output of an earlier pipe stage. It follows pipes, reduce and foreach, so
+// `[range(5)] | map(. * 2)` and `reduce range(5) as $i (0; . + $i)` are
+// recognised as generators.
+func (jq *JQ) UsesInput() bool {
+	return usesInput(jq.program)
+}
+
+// generators are the builtins, by name and number of arguments, that only
+// read their input through their arguments.
+var generators = map[string]map[int]bool{
+	"empty":             {0: true},
+	"null":              {0: true},
+	"true":              {0: true},
+	"false":             {0: true},
+	"now":               {0: true},
+	"env":               {0: true},
+	"builtins":          {0: true},
+	"input_filename":    {0: true},
+	"input_line_number": {0: true},
+	"infinite":          {0: true},
+	"nan":               {0: true},
+	"halt":              {0: true},
+	"get_search_list":   {0: true},
+	"get_prog_origin":   {0: true},
+	"get_jq_origin":     {0: true},
+	"range":             {1: true, 2: true, 3: true},
+	"error":             {1: true},
+	"limit":             {2: true},
+	"first":             {1: true},
+	"last":              {1: true},
+	"nth":               {2: true},
+	"isempty":           {1: true},
+	"fromstream":        {1: true},
+}
+
+var jqKeywords = map[string]bool{
+	"def": true, "if": true, "then": true, "elif": true, "else": true, "end": true,
+	"as": true, "reduce": true, "foreach": true, "try": true, "catch": true,
+	"label": true, "import": true, "include": true, "and": true, "or": true,
+	"__loc__": true,
+}
+
+// scope is one level of nesting in the program: a bracketed expression, an
+// if, or a function body.
+type scope struct {
+	close string // the token that ends it
+
+	// piped is set once . in the current expression is the output of an
+	// earlier stage rather than the scope's own input, and base if the
+	// scope's own input is already not the program's.
+	piped, base bool
+
+	binding    bool // saw `as` or `label`, so the next | is not a pipe
+	reduce     bool // saw reduce or foreach, waiting for its `as`
+	reduceAs   bool // the next ( starts the reduce or foreach body
+	reduceBody bool // is the (init; update; extract) of reduce or foreach
+	defHeader  bool // between def and the : that starts the body
+	params     bool // is a def's parameter list
+
+	call     string // the function this scope holds the arguments of
+	callSafe bool   // whether the call's own input is not the program's
+	args     int
+
+	expectKey  bool // in an object, where the next token is a key
+	pendingKey bool // in an object, after a key that has no value yet
+}
+
+func usesInput(program string) bool {
+	tokens, ok := lexJq(program)
+	if !ok || len(tokens) == 0 {
+		return true
+	}
+
+	defined := map[string]bool{}
+	scopes := []*scope{{}}
+	push := func(close string) *scope {
+		outer := scopes[len(scopes)-1]
+		s := &scope{close: close, base: outer.piped, piped: outer.piped}
+		scopes = append(scopes, s)
+		return s
+	}
+
+	for i, tok := range tokens {
+		cur := scopes[len(scopes)-1]
+		var prev, next jqToken
+		if i > 0 {
+			prev = tokens[i-1]
+		}
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+
+		if cur.expectKey {
+			switch tok.kind {
+			case tokIdent, tokKeyword, tokStringStart, tokFormat:
+				cur.expectKey, cur.pendingKey = false, true
+				continue
+			case tokVar:
+				cur.expectKey = false
+				continue
+			}
+		}
+
+		switch tok.kind {
+		case tokIdent:
+			switch {
+			case cur.params || cur.defHeader:
+				defined[tok.text] = true
+			case tok.text == "input" || tok.text == "inputs":
+				return true
+			case next.kind == tokPunct && next.text == "(":
+				// decided when the arguments are closed
+			case !cur.piped && !defined[tok.text] && !generators[tok.text][0]:
+				return true
+			}
+
+		case tokKeyword:
+			switch tok.text {
+			case "def":
+				cur.defHeader = true
+			case "if":
+				push("end")
+			case "then", "elif", "else":
+				cur.piped = cur.base
+			case "end":
+				if cur.close != "end" {
+					return true
+				}
+				scopes = scopes[:len(scopes)-1]
+			case "reduce", "foreach":
+				cur.reduce = true
+			case "as":
+				if cur.reduce {
+					cur.reduce, cur.reduceAs = false, true
+				} else {
+					cur.binding = true
+				}
+			case "label":
+				cur.binding = true
+			}
+
+		case tokField, tokDot, tokRecurse:
+			if !endsTerm(prev) && !cur.piped {
+				return true
+			}
+
+		case tokFormat:
+			if next.kind != tokStringStart && !cur.piped {
+				return true
+			}
+
+		case tokPunct:
+			switch tok.text {
+			case "(":
+				// a computed key, as in {(k): v}
+				cur.expectKey = false
+				wasPiped := cur.piped
+				s := push(")")
+				switch {
+				case cur.defHeader:
+					s.params = true
+				case cur.reduceAs:
+					cur.reduceAs = false
+					s.reduceBody = true
+				case prev.kind == tokIdent && !cur.params:
+					s.call, s.callSafe = prev.text, wasPiped || defined[prev.text]
+				}
+			case `\(`:
+				push(")")
+			case "[":
+				push("]")
+			case "{":
+				push("}").expectKey = true
+			case ")", "]", "}":
+				if cur.close != tok.text {
+					return true
+				}
+				if cur.pendingKey && !cur.base {
+					// {a} is short for {a: .a}
+					return true
+				}
+				scopes = scopes[:len(scopes)-1]
+				if cur.call != "" && !cur.callSafe && !generators[cur.call][cur.args+1] {
+					return true
+				}
+			case "|":
+				if cur.binding {
+					cur.binding = false
+				} else {
+					cur.piped = true
+				}
+			case ",":
+				if cur.close == "}" {
+					if cur.pendingKey && !cur.base {
+						return true
+					}
+					cur.piped, cur.expectKey, cur.pendingKey = cur.base, true, false
+				}
+			case ":":
+				if cur.defHeader {
+					cur.defHeader = false
+					push(";")
+				} else {
+					cur.pendingKey = false
+				}
+			case ";":
+				switch {
+				case cur.close == ";":
+					scopes = scopes[:len(scopes)-1]
+				case cur.reduceBody:
+					// the update and extract see the accumulator
+					cur.piped, cur.base = true, true
+				case cur.close == ")":
+					cur.args++
+					cur.piped = cur.base
+				default:
+					cur.binding = false
+				}
+			}
+		}
+	}
+	return false
+}
+
+// endsTerm reports whether tok can end a term, in which case a field access
+// straight after it, as in $x.name, applies to that term.
+func endsTerm(tok jqToken) bool {
+	switch tok.kind {
+	case tokIdent, tokVar, tokField, tokNumber, tokString:
+		return true
+	case tokKeyword:
+		return tok.text == "end"
+	case tokPunct:
+		return tok.text == ")" || tok.text == "]" || tok.text == "}" || tok.text == "?"
+	}
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokNone tokenKind = iota
+	tokIdent
+	tokKeyword
+	tokVar
+	tokField   // .name
+	tokDot     // . on its own
+	tokRecurse // ..
+	tokNumber
+	tokFormat      // @name
+	tokStringStart // the opening quote
+	tokString      // the closing quote
+	tokPunct
+)
+
+type jqToken struct {
+	kind tokenKind
+	text string
+}
+
+// lexJq splits a jq program into tokens. String interpolations appear as
+// \( and ) around the tokens of the interpolated expression, between the
+// string's start and end. It returns false if the program is malformed.
+func lexJq(src string) ([]jqToken, bool) {
+	l := &jqLexer{src: src}
+	if !l.code(false) {
+		return nil, false
+	}
+	return l.tokens, true
+}
+
+type jqLexer struct {
+	src    string
+	pos    int
+	tokens []jqToken
+}
+
+var jqOperators = []string{"?//", "//=", "|=", "+=", "-=", "*=", "/=", "%=", "==", "!=", "<=", ">=", "//"}
+
+// code lexes until the end of the program or, in an interpolation, the )
+// that closes it.
+func (l *jqLexer) code(interpolation bool) bool {
+	depth := 0
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '"':
+			if !l.string() {
+				return false
+			}
+		case c == '.':
+			switch {
+			case l.pos+1 < len(l.src) && l.src[l.pos+1] == '.':
+				l.emit(tokRecurse, 2)
+			case l.pos+1 < len(l.src) && isDigit(l.src[l.pos+1]):
+				l.emit(tokNumber, l.number())
+			case l.pos+1 < len(l.src) && isIdentStart(l.src[l.pos+1]):
+				l.emit(tokField, 1+l.identLength(l.pos+1))
+			default:
+				l.emit(tokDot, 1)
+			}
+		case isDigit(c):
+			l.emit(tokNumber, l.number())
+		case isIdentStart(c):
+			n := l.identLength(l.pos)
+			kind := tokIdent
+			if jqKeywords[l.src[l.pos:l.pos+n]] {
+				kind = tokKeyword
+			}
+			l.emit(kind, n)
+		case c == '$':
+			// jq lexes $ and the name separately, so `$ ENV` is $ENV
+			i := l.skipSpace(l.pos + 1)
+			n := l.identLength(i)
+			if n == 0 {
+				l.emit(tokVar, 1)
+				break
+			}
+			l.tokens = append(l.tokens, jqToken{tokVar, "$" + l.src[i:i+n]})
+			l.pos = i + n
+		case c == '@':
+			l.emit(tokFormat, 1+l.identLength(l.pos+1))
+		default:
+			n := 1
+			for _, op := range jqOperators {
+				if len(l.src)-l.pos >= len(op) && l.src[l.pos:l.pos+len(op)] == op {
+					n = len(op)
+					break
+				}
+			}
+			if interpolation && c == ')' && depth == 0 {
+				l.emit(tokPunct, 1)
+				return true
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				depth--
+			}
+			l.emit(tokPunct, n)
+		}
+	}
+	return !interpolation
+}
+
+// skipSpace returns the position of the first character from i that is not
+// whitespace or part of a comment.
+func (l *jqLexer) skipSpace(i int) int {
+	for i < len(l.src) {
+		switch l.src[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		case '#':
+			for i < len(l.src) && l.src[i] != '\n' {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// string lexes a string literal, including any interpolations in it.
+func (l *jqLexer) string() bool {
+	l.emit(tokStringStart, 1)
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case '"':
+			l.emit(tokString, 1)
+			return true
+		case '\\':
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == '(' {
+				l.emit(tokPunct, 2)
+				if !l.code(true) {
+					return false
+				}
+			} else {
+				l.pos += 2
+			}
+		default:
+			l.pos++
+		}
+	}
+	return false
+}
+
+func (l *jqLexer) emit(kind tokenKind, n int) {
+	if l.pos+n > len(l.src) {
+		n = len(l.src) - l.pos
+	}
+	l.tokens = append(l.tokens, jqToken{kind, l.src[l.pos : l.pos+n]})
+	l.pos += n
+}
+
+// number returns the length of the number literal at the current position.
+func (l *jqLexer) number() int {
+	i := l.pos
+	for i < len(l.src) && isDigit(l.src[i]) {
+		i++
+	}
+	if i < len(l.src) && l.src[i] == '.' {
+		i++
+		for i < len(l.src) && isDigit(l.src[i]) {
+			i++
+		}
+	}
+	if i < len(l.src) && (l.src[i] == 'e' || l.src[i] == 'E') {
+		j := i + 1
+		if j < len(l.src) && (l.src[j] == '+' || l.src[j] == '-') {
+			j++
+		}
+		if j < len(l.src) && isDigit(l.src[j]) {
+			i = j
+			for i < len(l.src) && isDigit(l.src[i]) {
+				i++
+			}
+		}
+	}
+	return i - l.pos
+}
+
+// identLength returns the length of the identifier, which may include
+// module prefixes such as mod::name, starting at i.
+func (l *jqLexer) identLength(i int) int {
+	start := i
+	for i < len(l.src) {
+		c := l.src[i]
+		switch {
+		case isIdentStart(c) || isDigit(c):
+			i++
+		case c == ':' && i+2 < len(l.src) && l.src[i+1] == ':' && isIdentStart(l.src[i+2]):
+			i += 2
+		default:
+			return i - start
+		}
+	}
+	return i - start
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,62 @@
+package jq
+
+import "testing"
+
+func TestUsesInput(t *testing.T) {
+	for _, tc := range []struct {
+		program string
+		uses    bool
+	}{
+		{``, true},
+		{`.`, true},
+		{`.a`, true},
+		{`..`, true},
+		{`.[0]`, true},
+		{`length`, true},
+		{`1, .`, true},
+		{`{a}`, true},
+		{`{"a"}`, true},
+		{`{b: 1, a}`, true},
+		{`"\(.)"`, true},
+		{`@base64`, true},
+		{`input`, true},
+		{`[inputs]`, true},
+		{`error`, true},
+		{`nth(1)`, true},
+		{`limit(3; repeat(1))`, true},
+		{`reduce .[] as $x (0; . + $x)`, true},
+		{`reduce range(3) as $i (.; . + $i)`, true},
+		{`1 as $x | . + $x`, true},
+		{`(1 | .), .`, true},
+		{`if . then 1 else 2 end`, true},
+		{`if true then 1 | . else . end`, true},
+		{`def f: .a; f`, true},
+		{`def f(g): g; f(.)`, true},
+
+		{`1`, false},
+		{`"abc"`, false},
+		{`# a comment` + "\n" + `null`, false},
+		{`[range(5)]`, false},
+		{`[range(5)] | map(. * 2)`, false},
+		{`{a: 1, "b": [2], (3 | tostring): $__loc__}`, false},
+		{`{a: 1}.a`, false},
+		{`$ENV.HOME, env.HOME`, false},
+		{`"\(1 + 2)"`, false},
+		{`@base64 "x\(1)"`, false},
+		{`now | todate`, false},
+		{`first(range(10)), limit(2; range(5)), nth(1; range(5))`, false},
+		{`reduce range(5) as $i (0; . + $i)`, false},
+		{`foreach range(3) as $i (0; . + $i; [$i, .])`, false},
+		{`label $out | foreach range(5) as $i (0; . + $i; if . > 3 then ., break $out else . end)`, false},
+		{`1 as $x | $x + 1`, false},
+		{`1 as [$x] | [$x] | .[0]`, false},
+		{`def f: 1; def g($x): $x + f; g(2)`, false},
+		{`if true then 1 else 2 end`, false},
+		{`try error("x") catch "caught"`, false},
+	} {
+		jq, err := NewJQ(tc.program)
+		ok(t, err)
+		assert(t, jq.UsesInput() == tc.uses, "UsesInput(%q) = %v, want %v", tc.program, !tc.uses, tc.uses)
+		jq.Close()
+	}
+}
@@ -0,0 +1,277 @@
+package jq
+
+// #include <jv.h>
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Value is a reference to a jq value that has not been converted to Go. It
+// lets callers inspect large outputs piece by piece instead of decoding them
+// in full with jvToGo.
+//
+// A Value owns one reference to the underlying jv and must be released with
+// Free exactly once. Values derived from it, such as ArrayGet results, hold
+// their own references and are freed separately.
+type Value struct {
+	jv       C.jv
+	sortKeys bool
+}
+
+// ValueRef returns a reference to the current output. The caller owns it and
+// it stays usable after Next or Close. It follows the instance's key
+// ordering policy, see SetSortKeys.
+func (jq *JQ) ValueRef() Value {
+	return trackValue(Value{C.jv_copy(jq.lastValue), jq.sortKeys})
+}
+
+// Free releases the reference held by v.
+func (v Value) Free() {
+	untrackValue(v)
+	freeJv(v.jv)
+}
+
+// Json returns the compact JSON encoding of v.
+func (v Value) Json() string {
+	if v.sortKeys {
+		return dumpJsonFlags(v.jv, C.JV_PRINT_SORTED)
+	}
+	return dumpJson(v.jv)
+}
+
+// EqualJSON reports whether got, a Go value as accepted by Handle, equals
+// the JSON text want by jq's rules: numbers compare by value, so 1 and 1.0
+// are equal, and object keys in any order. It is meant for tests of filter
+// outputs, where reflect.DeepEqual tells int from float64. It returns false
+// if either value cannot be converted.
+func EqualJSON(got interface{}, want string) bool {
+	wantJv, err := parseJson(want)
+	if err != nil {
+		return false
+	}
+	gotJv := trackJv(newEncoder(0).encode(got))
+	if !isValid(gotJv) {
+		freeJv(gotJv)
+		freeJv(wantJv)
+		return false
+	}
+	return C.jv_equal(gotJv, wantJv) != 0
+}
+
+// ParseExpecting parses text as a single JSON value and converts it as
+// JQ.Value does, returning an error if its jq type name, as ValueKind gives
+// it, is not kind. It suits checking that a request body is an object
+// before doing anything else with it.
+func ParseExpecting(text string, kind string) (interface{}, error) {
+	switch kind {
+	case "null", "boolean", "number", "string", "array", "object":
+	default:
+		return nil, fmt.Errorf("Unknown JSON kind %q", kind)
+	}
+	jv, err := parseJson(text)
+	if err != nil {
+		return nil, err
+	}
+	defer freeJv(jv)
+	if actual := kindName(C.jv_get_kind(jv)); actual != kind {
+		return nil, fmt.Errorf("Expected JSON %s, got %s", kind, actual)
+	}
+	return jvToGo(jv), nil
+}
+
+// Kind returns the jq type name of v, as JQ.ValueKind does.
+func (v Value) Kind() string {
+	return kindName(C.jv_get_kind(v.jv))
+}
+
+// ToGo converts v in full to Go values, as JQ.Value does. The result shares
+// no memory with jq, so v can be freed, and its JQ closed, straight after.
+func (v Value) ToGo() interface{} {
+	return jvToGo(v.jv)
+}
+
+// The scalar accessors below read v without converting it to an
+// interface{}, so unlike ToGo they do not allocate.
+
+// IsNull reports whether v is null.
+func (v Value) IsNull() bool {
+	return C.jv_get_kind(v.jv) == C.JV_KIND_NULL
+}
+
+// Bool returns v as a bool. It panics if v is not a boolean.
+func (v Value) Bool() bool {
+	switch C.jv_get_kind(v.jv) {
+	case C.JV_KIND_TRUE:
+		return true
+	case C.JV_KIND_FALSE:
+		return false
+	}
+	v.mustBe(C.JV_KIND_TRUE, "Bool")
+	return false
+}
+
+// Float returns v as a float64. It panics if v is not a number.
+func (v Value) Float() float64 {
+	v.mustBe(C.JV_KIND_NUMBER, "Float")
+	return float64(C.jv_number_value(v.jv))
+}
+
+// Int returns v as an int, truncating any fraction toward zero as a Go
+// conversion does. It panics if v is not a number.
+func (v Value) Int() int {
+	v.mustBe(C.JV_KIND_NUMBER, "Int")
+	return int(C.jv_number_value(v.jv))
+}
+
+// ArrayLen returns the number of elements in v. It panics if v is not an
+// array.
+func (v Value) ArrayLen() int {
+	v.mustBe(C.JV_KIND_ARRAY, "ArrayLen")
+	return int(C.jv_array_length(C.jv_copy(v.jv)))
+}
+
+// ArrayGet returns the i'th element of v without decoding the rest of the
+// array. It panics if v is not an array or i is out of range.
+func (v Value) ArrayGet(i int) Value {
+	if n := v.ArrayLen(); i < 0 || i >= n {
+		panic(fmt.Sprintf("jq: ArrayGet index %d out of range [0:%d]", i, n))
+	}
+	return v.derive(trackJv(C.jv_array_get(C.jv_copy(v.jv), C.int(i))))
+}
+
+// ObjectGet returns the value of key in v, and whether it was present,
+// without decoding the rest of the object. It panics if v is not an object.
+func (v Value) ObjectGet(key string) (Value, bool) {
+	v.mustBe(C.JV_KIND_OBJECT, "ObjectGet")
+	field := trackJv(C.jv_object_get(C.jv_copy(v.jv), jvString(key)))
+	if !isValid(field) {
+		freeJv(field)
+		return Value{jv: C.jv_invalid()}, false
+	}
+	return v.derive(field), true
+}
+
+// Keys returns the keys of v, sorted if the key ordering policy asks for it
+// and in insertion order otherwise. It panics if v is not an object.
+func (v Value) Keys() []string {
+	v.mustBe(C.JV_KIND_OBJECT, "Keys")
+	keys := make([]string, 0, int(C.jv_object_length(C.jv_copy(v.jv))))
+	for i := C.jv_object_iter(v.jv); C.jv_object_iter_valid(v.jv, i) != 0; i = C.jv_object_iter_next(v.jv, i) {
+		k := trackJv(C.jv_object_iter_key(v.jv, i))
+		keys = append(keys, jvGoString(k))
+		freeJv(k)
+	}
+	if v.sortKeys {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
+// The constructors below build Values directly, for callers that can
+// produce jq values more cheaply than by converting Go values with Handle,
+// e.g. straight from a protobuf or other binary decoder. Each returns a
+// Value owned by the caller, and those that take Values take ownership of
+// them, so they must not be used or freed afterwards.
+
+// NullValue returns a null Value.
+func NullValue() Value {
+	return Value{jv: C.jv_null()}
+}
+
+// BoolValue returns true or false as a Value.
+func BoolValue(b bool) Value {
+	if b {
+		return Value{jv: C.jv_true()}
+	}
+	return Value{jv: C.jv_false()}
+}
+
+// NumberValue returns n as a Value.
+func NumberValue(n float64) Value {
+	return Value{jv: C.jv_number(C.double(n))}
+}
+
+// StringValue returns s as a Value.
+func StringValue(s string) Value {
+	return trackValue(Value{jv: jvString(s)})
+}
+
+// ArrayValue returns an array of items, taking ownership of them.
+func ArrayValue(items ...Value) Value {
+	arr := C.jv_array_sized(C.int(len(items)))
+	for i, item := range items {
+		untrackValue(item)
+		arr = C.jv_array_set(arr, C.int(i), item.jv)
+	}
+	return trackValue(Value{jv: arr})
+}
+
+// ObjectValue returns an empty object; add to it with With.
+func ObjectValue() Value {
+	return trackValue(Value{jv: C.jv_object()})
+}
+
+// With returns object v with key set to value, taking ownership of both v
+// and value. It panics if v is not an object.
+func (v Value) With(key string, value Value) Value {
+	v.mustBe(C.JV_KIND_OBJECT, "With")
+	untrackValue(v)
+	untrackValue(value)
+	return v.derive(C.jv_object_set(v.jv, jvString(key), value.jv))
+}
+
+// HandleFunc starts the filter on the Value returned by produce, taking
+// ownership of it. This is an escape hatch for inputs that are faster to
+// build with the Value constructors than to convert with Handle. If produce
+// fails its error is returned and, as when Handle fails, the outputs of any
+// previous input are discarded.
+func (jq *JQ) HandleFunc(produce func() (Value, error)) error {
+	v, err := produce()
+	untrackValue(v)
+	if err != nil {
+		if isValid(v.jv) {
+			freeJv(v.jv)
+		}
+	} else if !isValid(v.jv) {
+		freeJv(v.jv)
+		err = errors.New("HandleFunc given an invalid value")
+	}
+	if err != nil {
+		jq.drain()
+		jq.forgetInput()
+		return err
+	}
+	jq.start(v.jv)
+	return nil
+}
+
+func (v Value) derive(jv C.jv) Value {
+	return trackValue(Value{jv, v.sortKeys})
+}
+
+func (v Value) mustBe(kind C.jv_kind, method string) {
+	if actual := C.jv_get_kind(v.jv); actual != kind {
+		panic(fmt.Sprintf("jq: %s called on %s value", method, kindName(actual)))
+	}
+}
+
+// kindName matches jv_kind_name without a call into C.
+func kindName(kind C.jv_kind) string {
+	switch kind {
+	case C.JV_KIND_NULL:
+		return "null"
+	case C.JV_KIND_FALSE, C.JV_KIND_TRUE:
+		return "boolean"
+	case C.JV_KIND_NUMBER:
+		return "number"
+	case C.JV_KIND_STRING:
+		return "string"
+	case C.JV_KIND_ARRAY:
+		return "array"
+	case C.JV_KIND_OBJECT:
+		return "object"
+	}
+	return "<invalid>"
+}
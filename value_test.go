@@ -0,0 +1,277 @@
+package jq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func parsedValue(t *testing.T, json string) Value {
+	jv, err := parseJson(json)
+	ok(t, err)
+	return Value{jv: jv}
+}
+
+func TestValueRef(t *testing.T) {
+	jq, err := NewJQ(".[]")
+	ok(t, err)
+
+	jq.HandleJson(`[[1, 2], [3]]`)
+	equals(t, true, jq.Next())
+	v := jq.ValueRef()
+	equals(t, true, jq.Next())
+	jq.Close()
+
+	// the reference outlives both the output and the instance
+	equals(t, "[1,2]", v.Json())
+	v.Free()
+}
+
+func TestValueToGo(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	ok(t, jq.HandleJson(`{"a": [1, 2.5, "x", null, true], "b": {"c": {}}}`))
+	equals(t, true, jq.Next())
+	v := jq.ValueRef()
+	jq.Close()
+
+	decoded := v.ToGo()
+	v.Free()
+	equals(t, map[string]interface{}{
+		"a": []interface{}{1, 2.5, "x", nil, true},
+		"b": map[string]interface{}{"c": map[string]interface{}{}},
+	}, decoded)
+}
+
+func TestValueScalars(t *testing.T) {
+	v := parsedValue(t, `[null, true, false, 42, -2.5]`)
+	defer v.Free()
+	items := make([]Value, v.ArrayLen())
+	for i := range items {
+		items[i] = v.ArrayGet(i)
+		defer items[i].Free()
+	}
+
+	equals(t, true, items[0].IsNull())
+	equals(t, false, items[1].IsNull())
+	equals(t, true, items[1].Bool())
+	equals(t, false, items[2].Bool())
+	equals(t, 42, items[3].Int())
+	equals(t, 42.0, items[3].Float())
+	equals(t, -2, items[4].Int())
+	equals(t, -2.5, items[4].Float())
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = items[0].IsNull() && items[1].Bool() && items[3].Int() == 42 && items[4].Float() < 0
+	})
+	equals(t, 0.0, allocs)
+}
+
+func TestValueScalarsWrongKind(t *testing.T) {
+	v := parsedValue(t, `"1"`)
+	defer v.Free()
+	defer func() {
+		equals(t, "jq: Int called on string value", recover())
+	}()
+	v.Int()
+}
+
+func TestValueBoolWrongKind(t *testing.T) {
+	v := parsedValue(t, `null`)
+	defer v.Free()
+	defer func() {
+		equals(t, "jq: Bool called on null value", recover())
+	}()
+	v.Bool()
+}
+
+func TestValueArrayLen(t *testing.T) {
+	v := parsedValue(t, `[1, "two", [3]]`)
+	defer v.Free()
+
+	equals(t, 3, v.ArrayLen())
+	equals(t, 3, v.ArrayLen())
+	equals(t, 1, refcount(v.jv))
+}
+
+func TestValueArrayGet(t *testing.T) {
+	v := parsedValue(t, `[1, "two", [3]]`)
+	defer v.Free()
+
+	first := v.ArrayGet(0)
+	equals(t, 1, jvToGo(first.jv))
+	first.Free()
+
+	last := v.ArrayGet(2)
+	equals(t, "[3]", last.Json())
+	last.Free()
+
+	equals(t, 1, refcount(v.jv))
+}
+
+func TestValueArrayGetOutOfRange(t *testing.T) {
+	v := parsedValue(t, `[1]`)
+	defer v.Free()
+	defer func() {
+		assert(t, recover() != nil, "expected ArrayGet to panic")
+	}()
+	v.ArrayGet(1)
+}
+
+func TestValueArrayLenWrongKind(t *testing.T) {
+	v := parsedValue(t, `{"a": 1}`)
+	defer v.Free()
+	defer func() {
+		equals(t, "jq: ArrayLen called on object value", recover())
+	}()
+	v.ArrayLen()
+}
+
+func TestValueObjectGet(t *testing.T) {
+	v := parsedValue(t, `{"a": 1, "b": {"c": [2]}}`)
+	defer v.Free()
+
+	b, found := v.ObjectGet("b")
+	equals(t, true, found)
+	c, found := b.ObjectGet("c")
+	equals(t, true, found)
+	equals(t, "[2]", c.Json())
+	c.Free()
+	b.Free()
+
+	_, found = v.ObjectGet("missing")
+	equals(t, false, found)
+
+	equals(t, 1, refcount(v.jv))
+}
+
+func TestValueKeys(t *testing.T) {
+	v := parsedValue(t, `{"b": 1, "a": 2, "c": 3}`)
+	defer v.Free()
+
+	equals(t, []string{"b", "a", "c"}, v.Keys())
+	equals(t, 1, refcount(v.jv))
+}
+
+func TestValueKeysSorted(t *testing.T) {
+	jq, err := NewJQ(".")
+	ok(t, err)
+	defer jq.Close()
+
+	jq.SetSortKeys(true)
+	jq.HandleJson(`{"b": 1, "a": {"y": 2, "x": 3}}`)
+	equals(t, true, jq.Next())
+	v := jq.ValueRef()
+	defer v.Free()
+
+	equals(t, []string{"a", "b"}, v.Keys())
+	a, _ := v.ObjectGet("a")
+	equals(t, []string{"x", "y"}, a.Keys())
+	equals(t, `{"x":3,"y":2}`, a.Json())
+	a.Free()
+}
+
+func TestValueKeysWrongKind(t *testing.T) {
+	v := parsedValue(t, `[1]`)
+	defer v.Free()
+	defer func() {
+		equals(t, "jq: Keys called on array value", recover())
+	}()
+	v.Keys()
+}
+
+func TestValueConstructors(t *testing.T) {
+	v := ObjectValue().
+		With("null", NullValue()).
+		With("ok", BoolValue(true)).
+		With("n", NumberValue(2.5)).
+		With("s", StringValue("a\x00b")).
+		With("list", ArrayValue(NumberValue(1), BoolValue(false), ArrayValue()))
+	defer v.Free()
+
+	equals(t, `{"null":null,"ok":true,"n":2.5,"s":"a\u0000b","list":[1,false,[]]}`, v.Json())
+	equals(t, 1, refcount(v.jv))
+}
+
+func TestHandleFunc(t *testing.T) {
+	jq, err := NewJQ(".items | length")
+	ok(t, err)
+	defer jq.Close()
+
+	ok(t, jq.HandleFunc(func() (Value, error) {
+		return ObjectValue().With("items", ArrayValue(NullValue(), NullValue())), nil
+	}))
+	equals(t, true, jq.Next())
+	equals(t, 2, jq.Value())
+
+	jq.Handle(map[string]interface{}{"items": []int{1}})
+	failed := errors.New("decode failed")
+	equals(t, failed, jq.HandleFunc(func() (Value, error) {
+		return Value{}, failed
+	}))
+	equals(t, false, jq.Next())
+
+	// a value returned with an error is still freed
+	outer := parsedValue(t, `[[1]]`)
+	defer outer.Free()
+	inner := outer.ArrayGet(0)
+	equals(t, failed, jq.HandleFunc(func() (Value, error) {
+		return inner, failed
+	}))
+	equals(t, 1, refcount(inner.jv))
+}
+
+func TestValueWithPanics(t *testing.T) {
+	v := NumberValue(1)
+	defer v.Free()
+	defer func() {
+		equals(t, "jq: With called on number value", recover())
+	}()
+	v.With("a", NullValue())
+}
+
+func TestEqualJSON(t *testing.T) {
+	for _, tc := range []struct {
+		got   interface{}
+		want  string
+		equal bool
+	}{
+		{1, `1.0`, true},
+		{1.5, `1.5`, true},
+		{map[string]interface{}{"a": 1, "b": []interface{}{2.0, "x"}}, `{"b": [2, "x"], "a": 1.0}`, true},
+		{nil, `null`, true},
+		{[]int{1, 2}, `[2, 1]`, false},
+		{map[string]int{"a": 1}, `{"a": 1, "b": 2}`, false},
+		{"1", `1`, false},
+		{1, `1 2`, false},
+		{make(chan int), `null`, false},
+	} {
+		equals(t, tc.equal, EqualJSON(tc.got, tc.want))
+	}
+}
+
+func TestParseExpecting(t *testing.T) {
+	v, err := ParseExpecting(`{"a": [1]}`, "object")
+	ok(t, err)
+	equals(t, map[string]interface{}{"a": []interface{}{1}}, v)
+
+	v, err = ParseExpecting(` false `, "boolean")
+	ok(t, err)
+	equals(t, false, v)
+
+	v, err = ParseExpecting(`null`, "null")
+	ok(t, err)
+	equals(t, nil, v)
+
+	_, err = ParseExpecting(`[{"a": 1}]`, "object")
+	equals(t, "Expected JSON object, got array", fmt.Sprint(err))
+
+	_, err = ParseExpecting(`"1"`, "number")
+	equals(t, "Expected JSON number, got string", fmt.Sprint(err))
+
+	_, err = ParseExpecting(`{"a": 1} {}`, "object")
+	equals(t, "Invalid JSON: Unexpected extra JSON values", fmt.Sprint(err))
+
+	_, err = ParseExpecting(`{}`, "map")
+	equals(t, `Unknown JSON kind "map"`, fmt.Sprint(err))
+}
@@ -0,0 +1,80 @@
+package jq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Version returns the minor version of the linked libjq as "1.6" or "1.7",
+// the latter meaning 1.7 or later. The package needs at least libjq 1.6,
+// whose halt support it calls directly. libjq does not report its own
+// version, so it is told from the builtins the library defines, once per
+// process.
+func Version() string {
+	return fmt.Sprintf("1.%d", linkedMinorVersion())
+}
+
+var (
+	detectVersion sync.Once
+	linkedMinor   int
+)
+
+// versionProbes names a builtin first defined in each version after 1.6,
+// newest first.
+var versionProbes = []struct {
+	builtin string
+	minor   int
+}{
+	{"pick/1", 7},
+}
+
+func linkedMinorVersion() int {
+	detectVersion.Do(func() {
+		linkedMinor = 6
+		all, err := runSingle("builtins", nil)
+		if err != nil {
+			return
+		}
+		defined := map[interface{}]bool{}
+		for _, name := range all.([]interface{}) {
+			defined[name] = true
+		}
+		for _, probe := range versionProbes {
+			if defined[probe.builtin] {
+				linkedMinor = probe.minor
+				return
+			}
+		}
+	})
+	return linkedMinor
+}
+
+// ErrUnsupported is wrapped by the errors of features the linked libjq is
+// too old for.
+var ErrUnsupported = errors.New("Not supported by linked jq")
+
+// feature is something this package offers that needs at least a given
+// version of libjq. Gating features here, rather than letting an old jq
+// misbehave, keeps the minimum versions in one place.
+type feature struct {
+	name  string
+	minor int // of jq 1.x
+}
+
+// jq_set_stderr_cb arrived in jq 1.7
+var featureStderr = feature{"SetStderrHandler", 7}
+
+// supported reports whether the linked libjq has f.
+func (f feature) supported() bool {
+	return linkedMinorVersion() >= f.minor
+}
+
+// check returns an error wrapping ErrUnsupported if the linked libjq does
+// not have f.
+func (f feature) check() error {
+	if f.supported() {
+		return nil
+	}
+	return fmt.Errorf("%w: %s needs jq 1.%d, linked jq is %s", ErrUnsupported, f.name, f.minor, Version())
+}
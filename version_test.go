@@ -0,0 +1,24 @@
+package jq
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	version := Version()
+	assert(t, version == "1.6" || version == "1.7", "unexpected version %q", version)
+	equals(t, version, Version())
+
+	// builtins are what the version is told from
+	_, err := NewJQ("pick(.a)")
+	equals(t, version == "1.7", err == nil)
+}
+
+func TestFeatureCheck(t *testing.T) {
+	ok(t, feature{"old", 5}.check())
+
+	err := feature{"Teleport", 99}.check()
+	assert(t, errors.Is(err, ErrUnsupported), "expected ErrUnsupported, got %v", err)
+	equals(t, "Not supported by linked jq: Teleport needs jq 1.99, linked jq is "+Version(), err.Error())
+}
@@ -0,0 +1,225 @@
+// Package yaml runs jq programs over YAML documents, the way yq does. It is
+// kept apart from package jq so that only programs that use it depend on
+// gopkg.in/yaml.v3.
+package yaml
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	jq "github.com/aj-bagwell/go-jq"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// maxAliases bounds how many times aliases are expanded when converting a
+// document, so a small document cannot expand into a huge value.
+const maxAliases = 10000
+
+// maxDepth bounds the nesting of a converted document. The JQ's own limit,
+// see SetMaxDepth, applies as well when the value is handled.
+const maxDepth = 10000
+
+// Handle parses text as a single YAML document and starts the filter on it.
+// Mapping keys become strings and keep their order; timestamps, binary and
+// other scalars without a JSON equivalent become strings as written.
+// Aliases and merge keys are expanded.
+func Handle(q *jq.JQ, text string) error {
+	dec := yamlv3.NewDecoder(strings.NewReader(text))
+	var doc yamlv3.Node
+	if err := dec.Decode(&doc); err == io.EOF {
+		q.Handle(nil)
+		return nil
+	} else if err != nil {
+		return errors.New("Invalid YAML: " + strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	var extra yamlv3.Node
+	if err := dec.Decode(&extra); err != io.EOF {
+		return errors.New("Invalid YAML: expected a single document")
+	}
+
+	value, err := (&converter{}).convert(&doc)
+	if err != nil {
+		return err
+	}
+	q.Handle(value)
+	return nil
+}
+
+// converter builds the Go value for a parsed document, with jq.Pairs for
+// mappings so their keys keep their order.
+type converter struct {
+	depth   int
+	aliases int
+}
+
+func (c *converter) convert(node *yamlv3.Node) (interface{}, error) {
+	c.depth++
+	defer func() { c.depth-- }()
+	if c.depth > maxDepth {
+		return nil, fmt.Errorf("Invalid YAML: exceeded maximum depth of %d", maxDepth)
+	}
+
+	switch node.Kind {
+	case yamlv3.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return c.convert(node.Content[0])
+	case yamlv3.AliasNode:
+		c.aliases++
+		if c.aliases > maxAliases {
+			return nil, errors.New("Invalid YAML: too many aliases")
+		}
+		return c.convert(node.Alias)
+	case yamlv3.SequenceNode:
+		items := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			v, err := c.convert(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return items, nil
+	case yamlv3.MappingNode:
+		return c.mapping(node)
+	default:
+		return scalar(node)
+	}
+}
+
+func (c *converter) mapping(node *yamlv3.Node) (interface{}, error) {
+	pairs := jq.Pairs{}
+	var merges []*yamlv3.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.ShortTag() == "!!merge" {
+			merges = append(merges, value)
+			continue
+		}
+		if key.Kind == yamlv3.AliasNode {
+			key = key.Alias
+		}
+		if key.Kind != yamlv3.ScalarNode {
+			return nil, errors.New("Invalid YAML: mapping keys must be scalars")
+		}
+		v, err := c.convert(value)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, jq.Pair{Key: key.Value, Value: v})
+	}
+
+	// keys given explicitly take precedence over merged ones, and earlier
+	// merged mappings over later ones
+	for _, merge := range merges {
+		sources := []*yamlv3.Node{merge}
+		if merge.Kind == yamlv3.SequenceNode {
+			sources = merge.Content
+		}
+		for _, source := range sources {
+			v, err := c.convert(source)
+			if err != nil {
+				return nil, err
+			}
+			merged, ok := v.(jq.Pairs)
+			if !ok {
+				return nil, errors.New("Invalid YAML: merge key must refer to a mapping")
+			}
+			pairs = mergePairs(merged, pairs)
+		}
+	}
+	return pairs, nil
+}
+
+// mergePairs returns base with the keys of over added or, where base has
+// them already, replaced in place, as jq's object merge orders them.
+func mergePairs(base, over jq.Pairs) jq.Pairs {
+	merged := append(jq.Pairs{}, base...)
+	index := make(map[string]int, len(merged))
+	for i, p := range merged {
+		if _, ok := index[p.Key]; !ok {
+			index[p.Key] = i
+		}
+	}
+	for _, p := range over {
+		if i, ok := index[p.Key]; ok {
+			merged[i].Value = p.Value
+		} else {
+			index[p.Key] = len(merged)
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+func scalar(node *yamlv3.Node) (interface{}, error) {
+	switch node.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err != nil {
+			return nil, errors.New("Invalid YAML: " + err.Error())
+		}
+		return b, nil
+	case "!!int", "!!float":
+		var f float64
+		if err := node.Decode(&f); err != nil {
+			return nil, errors.New("Invalid YAML: " + err.Error())
+		}
+		return f, nil
+	default:
+		return node.Value, nil
+	}
+}
+
+// Value returns the current output of q as a YAML document, keeping the
+// order of object keys unless SetSortKeys is on.
+func Value(q *jq.JQ) (string, error) {
+	if q.ValueKind() == "<invalid>" {
+		return "", errors.New("No value to convert to YAML")
+	}
+	var out strings.Builder
+	enc := yamlv3.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(toYAML(q.ValueNode())); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func toYAML(n jq.Node) *yamlv3.Node {
+	switch n.Kind {
+	case "boolean":
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(n.Bool)}
+	case "number":
+		tag := "!!float"
+		if _, err := strconv.ParseInt(n.Number, 10, 64); err == nil {
+			tag = "!!int"
+		}
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: tag, Value: n.Number}
+	case "string":
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: n.String}
+	case "array":
+		node := &yamlv3.Node{Kind: yamlv3.SequenceNode, Tag: "!!seq"}
+		for _, item := range n.Items {
+			node.Content = append(node.Content, toYAML(item))
+		}
+		return node
+	case "object":
+		node := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+		for _, f := range n.Fields {
+			node.Content = append(node.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: f.Key}, toYAML(f.Value))
+		}
+		return node
+	default:
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!null", Value: "null"}
+	}
+}
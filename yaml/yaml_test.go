@@ -0,0 +1,132 @@
+package yaml
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	jq "github.com/aj-bagwell/go-jq"
+)
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
+
+func TestHandle(t *testing.T) {
+	q, err := jq.NewJQ(".")
+	ok(t, err)
+	defer q.Close()
+
+	ok(t, Handle(q, `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  labels: {app: web, "tier": front}
+spec:
+  replicas: 3
+  ratio: 0.5
+  enabled: yes
+  debug: false
+  missing: ~
+  created: 2001-12-14
+  ports:
+    - 80
+    - "443"
+`))
+	equals(t, true, q.Next())
+	equals(t, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web","labels":{"app":"web","tier":"front"}},"spec":{"replicas":3,"ratio":0.5,"enabled":"yes","debug":false,"missing":null,"created":"2001-12-14","ports":[80,"443"]}}`, q.ValueJson())
+}
+
+func TestHandleAliases(t *testing.T) {
+	q, err := jq.NewJQ(".")
+	ok(t, err)
+	defer q.Close()
+
+	ok(t, Handle(q, `
+base: &base {a: 1, b: 2}
+other: &other {b: 3, c: 4}
+copy: *base
+merged:
+  <<: [*base, *other]
+  a: 0
+`))
+	equals(t, true, q.Next())
+	equals(t, map[string]interface{}{
+		"base":   map[string]interface{}{"a": 1, "b": 2},
+		"other":  map[string]interface{}{"b": 3, "c": 4},
+		"copy":   map[string]interface{}{"a": 1, "b": 2},
+		"merged": map[string]interface{}{"a": 0, "b": 2, "c": 4},
+	}, q.Value())
+}
+
+func TestHandleErrors(t *testing.T) {
+	q, err := jq.NewJQ(".")
+	ok(t, err)
+	defer q.Close()
+
+	for _, text := range []string{
+		"a: [1, 2",
+		"a: 1\n---\nb: 2\n",
+		"? [1, 2]\n: x\n",
+		"a: &a [*a]",
+	} {
+		err := Handle(q, text)
+		assert(t, err != nil && strings.HasPrefix(err.Error(), "Invalid YAML: "), "unexpected error for %q: %v", text, err)
+	}
+
+	ok(t, Handle(q, ""))
+	equals(t, true, q.Next())
+	equals(t, nil, q.Value())
+}
+
+func TestValue(t *testing.T) {
+	q, err := jq.NewJQ(".")
+	ok(t, err)
+	defer q.Close()
+
+	ok(t, q.HandleJson(`{"z": [1, 2.5, null], "a": {"s": "true", "n": "1", "t": true}}`))
+	equals(t, true, q.Next())
+	out, err := Value(q)
+	ok(t, err)
+	equals(t, `z:
+  - 1
+  - 2.5
+  - null
+a:
+  s: "true"
+  n: "1"
+  t: true
+`, out)
+
+	q.SetSortKeys(true)
+	out, err = Value(q)
+	ok(t, err)
+	assert(t, strings.HasPrefix(out, "a:\n"), "expected sorted keys: %s", out)
+}